@@ -8,8 +8,10 @@ import (
 	"net/http"
 	"net/http/pprof"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/libraries/daze"
@@ -140,13 +142,22 @@ func main() {
 			flCidrls = flag.String("c", filepath.Join(resExec, Conf.PathCIDR), "cidr path")
 			flCipher = flag.String("k", "daze", "password, should be same with the one specified by server")
 			flDnserv = flag.String("dns", "", "specifies the DNS, DoT or DoH server")
+			flDnslis = flag.String("dnsl", "", "listen address of dns server, queries are routed by the rules")
+			flDnsrem = flag.String("dnsr", daze.ResolverPublic.Cloudflare.Dns, "dns server used for remote names, through the tunnel")
 			flFilter = flag.String("f", "rule", "filter {rule, remote, locale}")
+			flFakeip = flag.String("fakeip", "", "answer remote names with fake ips from the pool, for example, 198.18.0.0/15")
 			flGpprof = flag.String("g", "", "specify an address to enable net/http/pprof")
 			flLimits = flag.String("b", "", "set the maximum bandwidth in bytes per second, for example, 128k or 1.5m")
-			flListen = flag.String("l", "127.0.0.1:1080", "listen address")
+			flLitera = flag.Bool("literal", false, "route only literal ips by cidr, domains never hit the local dns")
+			flListen = flag.String("l", "127.0.0.1:1080", "listen address, comma separated for multiple addresses")
+			flPasswd = flag.String("u", "", "require authentication, comma separated user:pass pairs, for example a:1,b:2")
+			flPolicy = flag.String("policy", "first", "policy {first, any-local, all-local, prefer-ipv4, prefer-ipv6}")
 			flProtoc = flag.String("p", "ashe", "protocol {ashe, baboon, czar, dahlia, etch}")
+			flRedirs = flag.String("redir", "", "listen address of transparent proxy for iptables redirect, linux only")
 			flRulels = flag.String("r", filepath.Join(resExec, Conf.PathRule), "rule path")
 			flServer = flag.String("s", "127.0.0.1:1081", "server address")
+			flTundev = flag.String("tun", "", "name of tun device to capture all traffic of the machine, linux only")
+			flTproxy = flag.String("tproxy", "", "listen address of transparent udp proxy for iptables tproxy, linux only")
 		)
 		flag.Parse()
 		log.Println("main: remote server is", *flServer)
@@ -159,44 +170,27 @@ func main() {
 		if *flLimits != "" {
 			log.Println("main: bandwidth is set", *flLimits)
 		}
+		var dialer daze.Dialer
 		switch *flProtoc {
 		case "ashe":
 			client := ashe.NewClient(*flServer, *flCipher)
 			if *flLimits != "" {
 				client.Limits = rate.NewLimits(daze.SizeParser(*flLimits), time.Second)
 			}
-			locale := daze.NewLocale(*flListen, daze.NewAimbot(client, &daze.AimbotOption{
-				Type: *flFilter,
-				Rule: *flRulels,
-				Cidr: *flCidrls,
-			}))
-			defer locale.Close()
-			doa.Nil(locale.Run())
+			dialer = client
 		case "baboon":
 			client := baboon.NewClient(*flServer, *flCipher)
 			if *flLimits != "" {
 				client.Limits = rate.NewLimits(daze.SizeParser(*flLimits), time.Second)
 			}
-			locale := daze.NewLocale(*flListen, daze.NewAimbot(client, &daze.AimbotOption{
-				Type: *flFilter,
-				Rule: *flRulels,
-				Cidr: *flCidrls,
-			}))
-			defer locale.Close()
-			doa.Nil(locale.Run())
+			dialer = client
 		case "czar":
 			client := czar.NewClient(*flServer, *flCipher)
 			if *flLimits != "" {
 				client.Limits = rate.NewLimits(daze.SizeParser(*flLimits), time.Second)
 			}
 			defer client.Close()
-			locale := daze.NewLocale(*flListen, daze.NewAimbot(client, &daze.AimbotOption{
-				Type: *flFilter,
-				Rule: *flRulels,
-				Cidr: *flCidrls,
-			}))
-			defer locale.Close()
-			doa.Nil(locale.Run())
+			dialer = client
 		case "dahlia":
 			client := dahlia.NewClient(*flListen, *flServer, *flCipher)
 			if *flLimits != "" {
@@ -210,13 +204,80 @@ func main() {
 				client.Limits = rate.NewLimits(daze.SizeParser(*flLimits), time.Second)
 			}
 			defer client.Close()
-			locale := daze.NewLocale(*flListen, daze.NewAimbot(client, &daze.AimbotOption{
-				Type: *flFilter,
-				Rule: *flRulels,
-				Cidr: *flCidrls,
-			}))
-			defer locale.Close()
-			doa.Nil(locale.Run())
+			dialer = client
+		}
+		// Dahlia is a port forwarding protocol, all other protocols are served by the locale.
+		if dialer != nil {
+			option := &daze.AimbotOption{
+				Type:    *flFilter,
+				Rule:    *flRulels,
+				Cidr:    *flCidrls,
+				Policy:  doa.Try(daze.ParsePolicy(*flPolicy)),
+				Literal: *flLitera,
+			}
+			aimbot := daze.NewAimbot(dialer, option)
+			reload := []daze.Router{aimbot.Router}
+			var passwd *daze.Passwd
+			if *flPasswd != "" {
+				passwd = daze.NewPasswd(*flPasswd)
+				log.Println("main: authentication is enabled")
+			}
+			for _, locale := range daze.NewLocaleMulti(*flListen, aimbot, passwd) {
+				defer locale.Close()
+				doa.Nil(locale.Run())
+			}
+			if *flRedirs != "" {
+				redirect := daze.NewRedirect(*flRedirs, aimbot)
+				defer redirect.Close()
+				doa.Nil(redirect.Run())
+			}
+			if *flTproxy != "" {
+				tproxy := daze.NewTproxy(*flTproxy, aimbot)
+				defer tproxy.Close()
+				doa.Nil(tproxy.Run())
+			}
+			if *flTundev != "" {
+				tun := daze.NewTun(*flTundev, aimbot)
+				defer tun.Close()
+				doa.Nil(tun.Run())
+			}
+			if *flDnslis != "" {
+				// Dns queries are routed by names only, ip based rules make no sense here.
+				router := func() daze.Router {
+					switch *flFilter {
+					case "locale":
+						return daze.NewRouterRight(daze.RoadLocale)
+					case "remote":
+						return daze.NewRouterRight(daze.RoadRemote)
+					}
+					routerRules := daze.NewRouterRules()
+					routerRules.FromFile(*flRulels)
+					return routerRules
+				}()
+				reload = append(reload, router)
+				dnserv := daze.NewDnserv(*flDnslis, dialer, *flDnsrem, router)
+				if *flFakeip != "" {
+					fakeip := daze.NewFakeip(*flFakeip)
+					dnserv.Fakeip = fakeip
+					aimbot.Fakeip = fakeip
+					log.Println("main: fake ip pool is", *flFakeip)
+				}
+				defer dnserv.Close()
+				doa.Nil(dnserv.Run())
+			}
+			// Rule files are loaded again on sighup, so they can be updated without a restart.
+			go func() {
+				c := make(chan os.Signal, 1)
+				signal.Notify(c, syscall.SIGHUP)
+				for range c {
+					log.Println("main: reload rule", *flRulels, *flCidrls)
+					for _, e := range reload {
+						if err := daze.RouterReload(e, option); err != nil {
+							log.Println("main:", err)
+						}
+					}
+				}
+			}()
 		}
 		if *flGpprof != "" {
 			_ = pprof.Handler
@@ -7,7 +7,9 @@ import (
 	"crypto/cipher"
 	"crypto/rc4"
 	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -20,17 +22,24 @@ import (
 	"math/rand/v2"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libraries/daze/lib/doa"
 	"github.com/libraries/daze/lib/expvpp"
 	"github.com/libraries/daze/lib/lru"
+	"github.com/libraries/daze/lib/pool"
 	"github.com/libraries/daze/lib/pretty"
+	"github.com/libraries/daze/lib/rate"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 // ============================================================================
@@ -49,29 +58,82 @@ import (
 
 // Conf is acting as package level configuration.
 var Conf = struct {
-	DialerTimeout time.Duration
-	RouterLruSize int
-	Socks5LruSize int
+	BinderTimeout  time.Duration
+	DialerTimeout  time.Duration
+	DnservTTL      uint32
+	FakeipLruSize  int
+	FakeipTTL      uint32
+	LinkIdleTime   time.Duration
+	LinkSpliceSize int64
+	ProxyLruSize   int
+	RouterFailTTL  time.Duration
+	RouterLruSize  int
+	RouterPassTTL  time.Duration
+	Socks5FragTime time.Duration
+	Socks5IdleTime time.Duration
+	Socks5LruSize  int
+	TproxyLruSize  int
+	TproxyTimeout  time.Duration
 }{
+	// The maximum time a bound listener waits for its inbound connection.
+	BinderTimeout: time.Second * 120,
 	DialerTimeout: time.Second * 8,
+	// The ttl in seconds of answers made by the dns server from the local resolver.
+	DnservTTL: 60,
+	// The maximum number of names mapped to fake ips. The least recently used name is forgotten when it is exceeded.
+	// It is capped by the size of the fake ip pool.
+	FakeipLruSize: 65536,
+	// The ttl in seconds of fake ip answers. A mapping is only forgotten once the cache is filled by newer names, which
+	// takes far longer than a few minutes with a pool of the suggested size, so apps never hold a forgotten mapping.
+	// Every answer and connection refreshes the mapping, and apps need not query again for every connection.
+	FakeipTTL: 300,
+	// A linked pair of connections is torn down if no bytes have flowed in either direction for this duration, so
+	// half-dead peers never pin goroutines and file descriptors forever. Zero means no limit.
+	LinkIdleTime: time.Minute * 5,
+	// The chunk size in which a link between tcp connections is spliced. Rate limits are accounted per chunk.
+	LinkSpliceSize: 1024 * 64,
+	// The maximum number of idle upstream connections kept by a http proxy session.
+	ProxyLruSize: 4,
 	// A single cache entry represents a single host or DNS name lookup. Make the cache as large as the maximum number
 	// of clients that access your web site concurrently. Note that setting the cache size too high is a waste of
 	// memory and degrades performance.
 	RouterLruSize: 128,
+	// The time a road is cached for. Roads decided after an error, for example a failed dns lookup, are cached for a
+	// much shorter time, so that a transient error does not pin the host to the wrong road.
+	RouterFailTTL: time.Second * 30,
+	RouterPassTTL: time.Minute * 30,
+	// The reassembly timer of socks5 udp fragments. RFC 1928 requires it to be no less than 5 seconds.
+	Socks5FragTime: time.Second * 5,
+	// A socks5 udp association is closed if no datagram has been relayed in either direction for this duration.
+	Socks5IdleTime: time.Minute * 5,
 	// The maximum number of udp connections allowed by socks5.
 	Socks5LruSize: 8,
+	// The maximum number of udp flows relayed by tproxy at the same time.
+	TproxyLruSize: 1024,
+	// A tproxy udp flow is closed if no datagram has been relayed in either direction for this duration.
+	TproxyTimeout: time.Second * 60,
 }
 
 // Expv is a simple wrapper around the expvars package.
 var Expv = struct {
+	LinkLive        *expvar.Int
+	LinkSplice      *expvar.Int
+	LocaleDeny      *expvar.Int
 	RouterCacheCall *expvar.Int
+	RouterCacheExpi *expvar.Int
 	RouterCacheHits *expvar.Int
+	RouterCacheWipe *expvar.Int
 	RouterCacheRate *expvar.Func
 	RouterIPNetCall *expvar.Int
 	RouterIPNetTime *expvpp.Average
 }{
+	LinkLive:        expvar.NewInt("Link.Live"),
+	LinkSplice:      expvar.NewInt("Link.Splice"),
+	LocaleDeny:      expvar.NewInt("Locale.Deny"),
 	RouterCacheCall: expvar.NewInt("RouterCache.Call"),
+	RouterCacheExpi: expvar.NewInt("RouterCache.Expi"),
 	RouterCacheHits: expvar.NewInt("RouterCache.Hits"),
+	RouterCacheWipe: expvar.NewInt("RouterCache.Wipe"),
 	RouterCacheRate: expvpp.NewPercent("RouterCache.Rate", "RouterCache.Hits", "RouterCache.Call"),
 	RouterIPNetCall: expvar.NewInt("RouterIPNet.Call"),
 	RouterIPNetTime: expvpp.NewAverage("RouterIPNet.Time", 64),
@@ -186,21 +248,130 @@ func ResolverAny(addr string) *net.Resolver {
 	panic("unreachable")
 }
 
-// Link copies from src to dst and dst to src until either EOF is reached.
+// Link copies from src to dst and dst to src until both EOF are reached. When one direction reaches EOF, only the
+// writing side of its destination is shut down, so the other direction keeps flowing. Both are closed if no bytes
+// have flowed in either direction for Conf.LinkIdleTime.
 func Link(a, b io.ReadWriteCloser) {
+	Expv.LinkLive.Add(1)
+	defer Expv.LinkLive.Add(-1)
+	last := &atomic.Int64{}
+	last.Store(time.Now().UnixNano())
+	if Conf.LinkIdleTime != 0 {
+		// Resetting a timer on every read is expensive. Instead, the timer fires once per period and checks the time of
+		// the last read. The mutex guarantees that the timer is never rearmed after it is stopped.
+		var (
+			m   = sync.Mutex{}
+			ttl *time.Timer
+		)
+		m.Lock()
+		ttl = time.AfterFunc(Conf.LinkIdleTime, func() {
+			m.Lock()
+			defer m.Unlock()
+			idle := time.Since(time.Unix(0, last.Load()))
+			if idle < Conf.LinkIdleTime {
+				ttl.Reset(Conf.LinkIdleTime - idle)
+				return
+			}
+			a.Close()
+			b.Close()
+		})
+		m.Unlock()
+		defer func() {
+			m.Lock()
+			defer m.Unlock()
+			ttl.Stop()
+		}()
+	}
 	w := sync.WaitGroup{}
 	w.Add(2)
 	go func() {
-		io.Copy(b, a)
-		b.Close()
+		if err := LinkCopy(b, a, last); err != nil || CloseWrite(b) != nil {
+			b.Close()
+		}
 		w.Done()
 	}()
 	go func() {
-		io.Copy(a, b)
-		a.Close()
+		if err := LinkCopy(a, b, last); err != nil || CloseWrite(a) != nil {
+			a.Close()
+		}
 		w.Done()
 	}()
 	w.Wait()
+	a.Close()
+	b.Close()
+}
+
+// LinkCopy copies from src to dst until EOF is reached, and records the time of the last transfer in unix nanoseconds.
+// If both are tcp connections underneath LimitsConn and drained PrefixConn wrappers, data is moved by splice(2)
+// without entering user space. It is then moved in chunks of Conf.LinkSpliceSize, and each chunk is accounted against
+// the limits after it is moved.
+func LinkCopy(dst, src io.ReadWriteCloser, last *atomic.Int64) error {
+	dstTCP, dstLim := LinkSplice(dst)
+	srcTCP, srcLim := LinkSplice(src)
+	if dstTCP == nil || srcTCP == nil {
+		_, err := io.Copy(dst, &LinkReader{Reader: src, Last: last})
+		return err
+	}
+	Expv.LinkSplice.Add(1)
+	lim := append(dstLim, srcLim...)
+	for {
+		// A splice returns only after a whole chunk is moved. The read deadline makes it return from time to time, so
+		// that the time of the last transfer is kept up to date for the idle check of slow links.
+		if Conf.LinkIdleTime != 0 {
+			srcTCP.SetReadDeadline(time.Now().Add(Conf.LinkIdleTime / 4))
+		}
+		n, err := dstTCP.ReadFrom(&io.LimitedReader{R: srcTCP, N: Conf.LinkSpliceSize})
+		if n != 0 {
+			last.Store(time.Now().UnixNano())
+			for _, e := range lim {
+				e.Wait(uint64(n))
+			}
+		}
+		switch {
+		case errors.Is(err, os.ErrDeadlineExceeded):
+		case err != nil:
+			return err
+		case n == 0:
+			return nil
+		}
+	}
+}
+
+// LinkSplice returns the tcp connection underlying c and the limits it passes through, or nil if c can not be
+// spliced.
+func LinkSplice(c io.Closer) (*net.TCPConn, []*rate.Limits) {
+	lim := []*rate.Limits{}
+	for {
+		switch v := c.(type) {
+		case *net.TCPConn:
+			return v, lim
+		case *LimitsConn:
+			lim = append(lim, v.Limits)
+			c = v.ReadWriteCloser
+		case *PrefixConn:
+			if len(v.Prefix) != 0 {
+				return nil, nil
+			}
+			c = v.ReadWriteCloser
+		default:
+			return nil, nil
+		}
+	}
+}
+
+// LinkReader is a reader which records the time of its last read in unix nanoseconds.
+type LinkReader struct {
+	io.Reader
+	Last *atomic.Int64
+}
+
+// Read reads up to len(p) bytes into p.
+func (r *LinkReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n != 0 {
+		r.Last.Store(time.Now().UnixNano())
+	}
+	return n, err
 }
 
 // ReadWriteCloser is the interface that groups the basic Read, Write and Close methods.
@@ -210,9 +381,106 @@ type ReadWriteCloser struct {
 	io.Closer
 }
 
+// LimitsConn is a connection whose reads and writes are accounted against the limits. Unlike wrapping a connection by
+// io.TeeReader and io.MultiWriter, it is seen through by Link, so a relay between tcp connections is still spliced.
+type LimitsConn struct {
+	io.ReadWriteCloser
+	Limits *rate.Limits
+}
+
+// Read reads up to len(p) bytes into p.
+func (c *LimitsConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.Limits.Wait(uint64(n))
+	return n, err
+}
+
+// Write writes len(p) bytes from p to the underlying connection.
+func (c *LimitsConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.Limits.Wait(uint64(n))
+	return n, err
+}
+
+// NewLimitsConn returns a new LimitsConn.
+func NewLimitsConn(c io.ReadWriteCloser, limits *rate.Limits) *LimitsConn {
+	return &LimitsConn{ReadWriteCloser: c, Limits: limits}
+}
+
+// PrefixConn is a connection with the bytes read ahead from it put back in front of it.
+type PrefixConn struct {
+	io.ReadWriteCloser
+	Prefix []byte
+}
+
+// Read reads up to len(p) bytes into p.
+func (c *PrefixConn) Read(p []byte) (int, error) {
+	if len(c.Prefix) != 0 {
+		n := copy(p, c.Prefix)
+		c.Prefix = c.Prefix[n:]
+		return n, nil
+	}
+	return c.ReadWriteCloser.Read(p)
+}
+
+// MultiCloser closes all of its closers.
+type MultiCloser []io.Closer
+
+// Close closes all closers and returns their errors joined.
+func (m MultiCloser) Close() error {
+	var err error
+	for _, c := range m {
+		err = errors.Join(err, c.Close())
+	}
+	return err
+}
+
+// Unwrap returns the connection wrapped by c, or nil if c is not a wrapper.
+func Unwrap(c io.Closer) io.Closer {
+	switch v := c.(type) {
+	case ReadWriteCloser:
+		return v.Closer
+	case *ReadWriteCloser:
+		return v.Closer
+	case *LimitsConn:
+		return v.ReadWriteCloser
+	case *PrefixConn:
+		return v.ReadWriteCloser
+	default:
+		return nil
+	}
+}
+
+// NetAddr returns the local and remote network address of the connection underlying c, it sees through the wrappers.
+// Nils are returned if there is no network connection underlying.
+func NetAddr(c io.ReadWriteCloser) (net.Addr, net.Addr) {
+	for e := io.Closer(c); e != nil; e = Unwrap(e) {
+		if v, ok := e.(net.Conn); ok {
+			return v.LocalAddr(), v.RemoteAddr()
+		}
+	}
+	return nil, nil
+}
+
+// CloseWrite shuts down the writing side of the connection underlying c, it sees through the wrappers. An
+// errors.ErrUnsupported is returned if the connection can not be half closed.
+func CloseWrite(c io.Closer) error {
+	for e := c; e != nil; e = Unwrap(e) {
+		if v, ok := e.(interface{ CloseWrite() error }); ok {
+			return v.CloseWrite()
+		}
+	}
+	return errors.ErrUnsupported
+}
+
 // Context carries infomations for a tcp connection.
 type Context struct {
 	Cid uint32
+	// Rip is the ip of the host evaluated by the last route, if any. The dialer connects to it rather than resolving
+	// the host again, so the connection goes to the very ip that decided the road.
+	Rip netip.Addr
+	// Rer is the error met by the last route, if any. The road is then only a guess.
+	Rer error
 }
 
 // Dialer abstracts the way to establish network connections.
@@ -220,19 +488,191 @@ type Dialer interface {
 	Dial(ctx *Context, network string, address string) (io.ReadWriteCloser, error)
 }
 
+// Binder abstracts the way to wait for an inbound connection, which is what the BIND command of socks needs.
+type Binder interface {
+	Bind(ctx *Context, network string, address string) (Bound, error)
+}
+
+// Bound is a listener created by a Binder. It accepts exactly one inbound connection.
+type Bound interface {
+	// Addr returns the address the listener is bound to, in host:port form.
+	Addr() string
+	// Accept waits for the inbound connection and returns it, along with the address of the peer.
+	Accept() (io.ReadWriteCloser, string, error)
+	// Close closes the listener. If the inbound connection has not yet been accepted, it is abandoned.
+	Close() error
+}
+
+// ErrBindPeer is returned by Bound.Accept if the inbound connection does not come from the bind destination.
+var ErrBindPeer = errors.New("daze: inbound peer is not the bind destination")
+
 // Direct is the default dialer for connecting to an address.
 type Direct struct{}
 
+// Bind implements daze.Binder.
+func (d *Direct) Bind(ctx *Context, network string, address string) (Bound, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	// The destination is used to evaluate the inbound connection, see RFC 1928. An unspecified one accepts any peer.
+	var peer []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if !ip.IsUnspecified() {
+			peer = append(peer, ip.Unmap())
+		}
+	} else {
+		l, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range l {
+			peer = append(peer, e.Unmap())
+		}
+	}
+	l, err := Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &DirectBound{l: l.(*net.TCPListener), peer: peer}, nil
+}
+
 // Dial implements daze.Dialer.
 func (d *Direct) Dial(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
 	return Dial(network, address)
 }
 
+// DirectBound is the Bound returned by Direct.
+type DirectBound struct {
+	l    *net.TCPListener
+	peer []netip.Addr
+}
+
+// Accept implements daze.Bound.
+func (b *DirectBound) Accept() (io.ReadWriteCloser, string, error) {
+	b.l.SetDeadline(time.Now().Add(Conf.BinderTimeout))
+	c, err := b.l.Accept()
+	if err != nil {
+		return nil, "", err
+	}
+	rem := c.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+	if len(b.peer) != 0 && !slices.Contains(b.peer, rem) {
+		c.Close()
+		return nil, "", ErrBindPeer
+	}
+	return c, c.RemoteAddr().String(), nil
+}
+
+// Addr implements daze.Bound.
+func (b *DirectBound) Addr() string {
+	return b.l.Addr().String()
+}
+
+// Close implements daze.Bound.
+func (b *DirectBound) Close() error {
+	return b.l.Close()
+}
+
+// Passwd is a credentials store shared by all front-ends of a Locale.
+type Passwd struct {
+	M map[string]string
+}
+
+// Check reports whether the username and password pair is valid.
+func (p *Passwd) Check(user string, pass string) bool {
+	want, ok := p.M[user]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(pass)) == 1
+}
+
+// NewPasswd returns a new Passwd. Parameter list is a comma separated list of user:pass pairs, for example
+// "alice:123456,bob:654321".
+func NewPasswd(list string) *Passwd {
+	p := &Passwd{M: map[string]string{}}
+	for _, e := range strings.Split(list, ",") {
+		if e == "" {
+			continue
+		}
+		seps := strings.SplitN(e, ":", 2)
+		doa.Doa(len(seps) == 2)
+		// RFC 1929 stores the length of username and password in a single byte.
+		doa.Doa(len(seps[0]) >= 1 && len(seps[0]) <= 255)
+		doa.Doa(len(seps[1]) >= 1 && len(seps[1]) <= 255)
+		p.M[seps[0]] = seps[1]
+	}
+	return p
+}
+
+// Access is an access control list of client source addresses shared by all front-ends of a Locale. An address is
+// denied if it is in any deny prefix, or if there are allow prefixes and it is in none of them. Clients without an ip
+// address, for example, clients of a unix domain socket, are never denied.
+type Access struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// Check reports whether the client at the address is allowed. A nil Access allows everyone.
+func (a *Access) Check(addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+	var ip netip.Addr
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		ip = v.AddrPort().Addr().Unmap()
+	case *net.UDPAddr:
+		ip = v.AddrPort().Addr().Unmap()
+	default:
+		return true
+	}
+	for _, e := range a.Deny {
+		if e.Contains(ip) {
+			return false
+		}
+	}
+	for _, e := range a.Allow {
+		if e.Contains(ip) {
+			return true
+		}
+	}
+	return len(a.Allow) == 0
+}
+
+// NewAccess returns a new Access. Each entry of the lists is a cidr, or a single ip address.
+func NewAccess(allow []string, deny []string) *Access {
+	parse := func(list []string) []netip.Prefix {
+		r := []netip.Prefix{}
+		for _, e := range list {
+			if addr, err := netip.ParseAddr(e); err == nil {
+				r = append(r, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+				continue
+			}
+			r = append(r, doa.Try(netip.ParsePrefix(e)).Masked())
+		}
+		return r
+	}
+	return &Access{Allow: parse(allow), Deny: parse(deny)}
+}
+
 // Locale is the main process of daze. In most cases, it is usually deployed as a daemon on a local machine.
+//
+// The locale listens on a tcp address, or on a unix domain socket if the address is prefixed by "unix:", for example,
+// unix:/run/daze.sock.
 type Locale struct {
+	// Access is the access control list of client source addresses. A nil Access means anyone can reach the locale.
+	Access *Access
+	// Chmode is the permission bits of the unix domain socket file. Zero leaves it as created under the umask.
+	Chmode os.FileMode
 	Closer io.Closer
 	Dialer Dialer
 	Listen string
+	// Passwd is used to authenticate clients. A nil Passwd means anyone can use the locale.
+	Passwd *Passwd
+	// Secure is the tls config used to terminate tls on the connections, before sniffing the protocol inside. A nil
+	// Secure serves in plain text.
+	Secure *tls.Config
 }
 
 // ServeProxy serves traffic in HTTP Proxy/Tunnel format.
@@ -242,12 +682,30 @@ type Locale struct {
 // See https://en.wikipedia.org/wiki/HTTP_tunnel
 // See https://www.infoq.com/articles/Web-Sockets-Proxy-Servers/
 func (l *Locale) ServeProxy(ctx *Context, cli io.ReadWriteCloser) error {
+	raw := cli
 	cliReader := bufio.NewReader(cli)
 	cli = ReadWriteCloser{
 		Reader: cliReader,
 		Writer: cli,
 		Closer: cli,
 	}
+	// A tunnel is linked to the raw connection once nothing is left in the read buffer, so that it is able to splice.
+	tun := func() io.ReadWriteCloser {
+		if cliReader.Buffered() == 0 {
+			return raw
+		}
+		return cli
+	}
+	// Upstream connections are kept idle between requests of the session, and closed when the session ends.
+	ups := lru.New[string, *ProxyUpstream](Conf.ProxyLruSize)
+	ups.Drop = func(k string, v *ProxyUpstream) {
+		v.Conn.Close()
+	}
+	defer func() {
+		for k := range ups.C {
+			ups.Del(k)
+		}
+	}()
 	var err error
 	for {
 		err = func() error {
@@ -256,6 +714,25 @@ func (l *Locale) ServeProxy(ctx *Context, cli io.ReadWriteCloser) error {
 				return err
 			}
 
+			// A request in origin form is addressed to the locale itself rather than to be proxied. The pac file is
+			// served without authentication, as browsers never send credentials for it.
+			if !r.URL.IsAbs() && r.Method == "GET" && (r.URL.Path == "/proxy.pac" || r.URL.Path == "/wpad.dat") {
+				return l.ServeProxyPac(ctx, cli, r)
+			}
+
+			// Proxy-Authorization is a hop-by-hop header consumed by the locale, it is never forwarded to the upstream.
+			auth := r.Header.Get("Proxy-Authorization")
+			r.Header.Del("Proxy-Authorization")
+			if l.Passwd != nil && !l.ServeProxyPasswd(auth) {
+				log.Printf("conn: %08x  error daze: authentication failed", ctx.Cid)
+				io.Copy(io.Discard, r.Body)
+				_, err := cli.Write([]byte("" +
+					"HTTP/1.1 407 Proxy Authentication Required\r\n" +
+					"Proxy-Authenticate: Basic realm=\"daze\"\r\n" +
+					"Content-Length: 0\r\n\r\n"))
+				return err
+			}
+
 			var port string
 			if r.URL.Port() == "" {
 				port = "80"
@@ -269,7 +746,11 @@ func (l *Locale) ServeProxy(ctx *Context, cli io.ReadWriteCloser) error {
 				log.Printf("conn: %08x  proto format=hproxy", ctx.Cid)
 			}
 
-			srv, err := l.Dialer.Dial(ctx, "tcp", r.URL.Hostname()+":"+port)
+			if r.Method != "CONNECT" && !(r.Method == "GET" && r.Header.Get("Upgrade") == "websocket") {
+				return l.ServeProxyHttp(ctx, cli, r, net.JoinHostPort(r.URL.Hostname(), port), ups)
+			}
+
+			srv, err := l.Dialer.Dial(ctx, "tcp", net.JoinHostPort(r.URL.Hostname(), port))
 			if err != nil {
 				return err
 			}
@@ -280,26 +761,14 @@ func (l *Locale) ServeProxy(ctx *Context, cli io.ReadWriteCloser) error {
 				if err != nil {
 					return err
 				}
-				Link(cli, srv)
+				Link(tun(), srv)
 				return io.EOF
 			}
-			if r.Method == "GET" && r.Header.Get("Upgrade") == "websocket" {
-				if err := r.Write(srv); err != nil {
-					return err
-				}
-				Link(cli, srv)
-				return io.EOF
-			}
-
-			srvReader := bufio.NewReader(srv)
 			if err := r.Write(srv); err != nil {
 				return err
 			}
-			s, err := http.ReadResponse(srvReader, r)
-			if err != nil {
-				return err
-			}
-			return s.Write(cli)
+			Link(tun(), srv)
+			return io.EOF
 		}()
 		if err != nil {
 			break
@@ -312,12 +781,190 @@ func (l *Locale) ServeProxy(ctx *Context, cli io.ReadWriteCloser) error {
 	return err
 }
 
+// ProxyUpstream is an upstream connection of a http proxy session. It is kept idle after a response is relayed, and
+// is reused by the later requests of the session to the same destination.
+type ProxyUpstream struct {
+	Conn   io.ReadWriteCloser
+	Reader *bufio.Reader
+}
+
+// ProxyHopHeader removes the hop-by-hop headers, which are meaningful only for a single connection and must not be
+// forwarded by proxies, including the headers listed in the Connection header.
+//
+// Introduction:
+// See https://datatracker.ietf.org/doc/html/rfc9110#section-7.6.1
+func ProxyHopHeader(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for e := range strings.SplitSeq(v, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				h.Del(e)
+			}
+		}
+	}
+	for _, e := range []string{
+		"Connection",
+		"Keep-Alive",
+		"Proxy-Authenticate",
+		"Proxy-Authorization",
+		"Proxy-Connection",
+		"Te",
+		"Trailer",
+		"Transfer-Encoding",
+		"Upgrade",
+	} {
+		h.Del(e)
+	}
+}
+
+// ServeProxyHttp relays a plain http request to dst, and relays its response back. The upstream connection is taken
+// from ups if there is an idle one, and is put back if it is still reusable after the response. Bodies are streamed in
+// both directions without being buffered. An io.EOF is returned if the client asks to close the session.
+func (l *Locale) ServeProxyHttp(
+	ctx *Context, cli io.Writer, r *http.Request, dst string, ups *lru.Lru[string, *ProxyUpstream],
+) error {
+	// The client connection and the upstream connection are kept alive independently. Whether the client wants to
+	// close is replied in the response, while the upstream is always asked to keep alive.
+	cls := r.Close
+	r.Close = false
+	ProxyHopHeader(r.Header)
+	// The request is written upstream along with its body before any response is read, so a client expecting
+	// 100-continue would wait for it forever. The expectation is met by the locale itself, and never sent upstream.
+	if strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		r.Header.Del("Expect")
+		if r.Body != http.NoBody && r.ProtoAtLeast(1, 1) {
+			if _, err := io.WriteString(cli, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+				return err
+			}
+		}
+	}
+	var (
+		err error
+		ok  bool
+		rep *http.Response
+		srv *ProxyUpstream
+	)
+	for {
+		srv, ok = ups.GetExists(dst)
+		if !ok {
+			con, err := l.Dialer.Dial(ctx, "tcp", dst)
+			if err != nil {
+				return err
+			}
+			srv = &ProxyUpstream{Conn: con, Reader: bufio.NewReader(con)}
+			ups.Set(dst, srv)
+		}
+		err = r.Write(srv.Conn)
+		if err == nil {
+			rep, err = http.ReadResponse(srv.Reader, r)
+		}
+		if err == nil {
+			break
+		}
+		ups.Del(dst)
+		// An idle upstream may have been closed by the server at any time. The request is retried on a new
+		// connection, as long as its body has not been consumed.
+		if !ok || r.Body != http.NoBody {
+			return err
+		}
+	}
+	// Informational responses are relayed as they are, until the final response arrives.
+	for rep.StatusCode >= 100 && rep.StatusCode <= 199 && rep.StatusCode != http.StatusSwitchingProtocols {
+		if err = rep.Write(cli); err != nil {
+			ups.Del(dst)
+			return err
+		}
+		if rep, err = http.ReadResponse(srv.Reader, r); err != nil {
+			ups.Del(dst)
+			return err
+		}
+	}
+	reuse := !rep.Close
+	ProxyHopHeader(rep.Header)
+	// A body delimited by the close of the upstream connection is chunked for the client, so the client connection
+	// is able to outlive it. Clients before http/1.1 know nothing about chunks, their connection is closed instead.
+	rep.Proto, rep.ProtoMajor, rep.ProtoMinor = "HTTP/1.1", 1, 1
+	if rep.ContentLength == -1 && len(rep.TransferEncoding) == 0 && r.Method != "HEAD" {
+		if r.ProtoAtLeast(1, 1) {
+			rep.TransferEncoding = []string{"chunked"}
+		} else {
+			cls = true
+		}
+	}
+	rep.Close = cls
+	err = rep.Write(cli)
+	rep.Body.Close()
+	if err != nil || !reuse {
+		ups.Del(dst)
+	}
+	if err != nil {
+		return err
+	}
+	if cls {
+		return io.EOF
+	}
+	return nil
+}
+
+// ServeProxyPac serves a pac file generated from the router of the dialer, so that browsers and systems are able to
+// configure the proxy automatically. Hosts on the locale road never touch the locale at all.
+//
+// Introduction:
+// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Proxy_servers_and_tunneling/Proxy_Auto-Configuration_PAC_file
+func (l *Locale) ServeProxyPac(ctx *Context, cli io.Writer, r *http.Request) error {
+	log.Printf("conn: %08x  proto format=pac", ctx.Cid)
+	io.Copy(io.Discard, r.Body)
+	// The host of the request is the address that the client used to reach the locale, it works even if the locale
+	// listens on all interfaces.
+	host := r.Host
+	if host == "" {
+		host = l.Listen
+	}
+	var router Router = NewRouterRight(RoadRemote)
+	if aimbot, ok := l.Dialer.(*Aimbot); ok {
+		router = aimbot.Router
+	}
+	body := Pac(router, "PROXY "+host+"; SOCKS5 "+host)
+	if l.Secure != nil {
+		body = Pac(router, "HTTPS "+host)
+	}
+	rep := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/x-ns-proxy-autoconfig"}},
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+	}
+	return rep.Write(cli)
+}
+
+// ServeProxyPasswd reports whether the value of a Proxy-Authorization header carries valid basic credentials.
+//
+// Introduction:
+// See https://datatracker.ietf.org/doc/html/rfc7617
+func (l *Locale) ServeProxyPasswd(auth string) bool {
+	scheme, data, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+	if err != nil {
+		return false
+	}
+	user, pass, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return false
+	}
+	return l.Passwd.Check(user, pass)
+}
+
 // ServeSocks4 serves traffic in SOCKS4/SOCKS4a format.
 //
 // Introduction:
 // See https://en.wikipedia.org/wiki/SOCKS
 // See http://ftp.icm.edu.pl/packages/socks/socks4/SOCKS4.protocol
 func (l *Locale) ServeSocks4(ctx *Context, cli io.ReadWriteCloser) error {
+	raw := cli
 	cliReader := bufio.NewReader(cli)
 	cli = ReadWriteCloser{
 		Reader: cliReader,
@@ -325,40 +972,27 @@ func (l *Locale) ServeSocks4(ctx *Context, cli io.ReadWriteCloser) error {
 		Closer: cli,
 	}
 	var (
-		dstHost   string
-		dstPort   uint16
-		dst       string
-		err       error
-		fCode     uint8
-		fDstIP    = make([]byte, 4)
-		fDstPort  = make([]byte, 2)
-		fHostName []byte
-		srv       io.ReadWriteCloser
+		dst   string
+		err   error
+		fCode uint8
+		srv   io.ReadWriteCloser
 	)
-	cliReader.Discard(1)
-	fCode, err = cliReader.ReadByte()
+	fCode, dst, err = ReadSocks4Request(cliReader)
 	if err != nil {
+		cli.Write([]byte{0x00, 0x5b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
 		return err
 	}
-	io.ReadFull(cliReader, fDstPort)
-	dstPort = binary.BigEndian.Uint16(fDstPort)
-	io.ReadFull(cliReader, fDstIP)
-	_, err = cliReader.ReadBytes(0x00)
-	if err != nil {
-		return err
+	log.Printf("conn: %08x  proto format=socks4", ctx.Cid)
+	// SOCKS4 carries no password, so it can not be used when authentication is required.
+	if l.Passwd != nil {
+		cli.Write([]byte{0x00, 0x5b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return errors.New("daze: authentication required")
 	}
-	if bytes.Equal(fDstIP[:3], []byte{0x00, 0x00, 0x00}) && fDstIP[3] != 0x00 {
-		fHostName, err = cliReader.ReadBytes(0x00)
-		if err != nil {
-			return err
-		}
-		fHostName = fHostName[:len(fHostName)-1]
-		dstHost = string(fHostName)
-	} else {
-		dstHost = net.IP(fDstIP).String()
+	// The request is served on the raw connection once nothing is left in the read buffer, so that it is able to
+	// splice.
+	if cliReader.Buffered() == 0 {
+		cli = raw
 	}
-	dst = dstHost + ":" + strconv.Itoa(int(dstPort))
-	log.Printf("conn: %08x  proto format=socks4", ctx.Cid)
 	switch fCode {
 	case 0x01:
 		srv, err = l.Dialer.Dial(ctx, "tcp", dst)
@@ -371,8 +1005,57 @@ func (l *Locale) ServeSocks4(ctx *Context, cli io.ReadWriteCloser) error {
 		}
 		return err
 	case 0x02:
-		panic("unreachable")
+		return l.ServeSocks4Bind(ctx, cli, dst)
+	}
+	cli.Write([]byte{0x00, 0x5b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	return ErrSocksCommand
+}
+
+// ServeSocks4Bind serves socks4 BIND command. Two replies are sent to the client: the first one carries the address
+// of the listener, and the second one is sent when the inbound connection arrives.
+func (l *Locale) ServeSocks4Bind(ctx *Context, cli io.ReadWriteCloser, dst string) error {
+	reply := func(code uint8, address string) []byte {
+		// If the DSTIP in the reply is 0 (the value of constant INADDR_ANY), then the client should replace it by the IP
+		// address of the SOCKS server to which the client is connected.
+		buf := []byte{0x00, code, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return buf
+		}
+		if ip := net.ParseIP(host).To4(); ip != nil && !ip.IsUnspecified() {
+			copy(buf[4:8], ip)
+		}
+		p, _ := strconv.Atoi(port)
+		binary.BigEndian.PutUint16(buf[2:4], uint16(p))
+		return buf
+	}
+	binder, ok := l.Dialer.(Binder)
+	if !ok {
+		cli.Write(reply(0x5b, ""))
+		return errors.New("daze: bind is not supported")
+	}
+	bnd, err := binder.Bind(ctx, "tcp", dst)
+	if err != nil {
+		cli.Write(reply(0x5b, ""))
+		return err
+	}
+	defer bnd.Close()
+	_, err = cli.Write(reply(0x5a, bnd.Addr()))
+	if err != nil {
+		return err
+	}
+	srv, rem, err := bnd.Accept()
+	if err != nil {
+		cli.Write(reply(0x5b, ""))
+		return err
+	}
+	log.Printf("conn: %08x  bind remote=%s", ctx.Cid, rem)
+	_, err = cli.Write(reply(0x5a, rem))
+	if err != nil {
+		srv.Close()
+		return err
 	}
+	Link(cli, srv)
 	return nil
 }
 
@@ -382,6 +1065,7 @@ func (l *Locale) ServeSocks4(ctx *Context, cli io.ReadWriteCloser) error {
 // See https://en.wikipedia.org/wiki/SOCKS
 // See https://tools.ietf.org/html/rfc1928
 func (l *Locale) ServeSocks5(ctx *Context, cli io.ReadWriteCloser) error {
+	raw := cli
 	cliReader := bufio.NewReader(cli)
 	cli = ReadWriteCloser{
 		Reader: cliReader,
@@ -389,84 +1073,242 @@ func (l *Locale) ServeSocks5(ctx *Context, cli io.ReadWriteCloser) error {
 		Closer: cli,
 	}
 	var (
-		dstHost  string
-		dstPort  uint16
 		dst      string
 		err      error
-		fAT      uint8
 		fCmd     uint8
-		fDstAddr []byte
-		fDstPort = make([]byte, 2)
-		fN       uint8
+		fMethod  uint8
+		fMethods []byte
 	)
-	cliReader.Discard(1)
-	fN = doa.Val(cliReader.ReadByte())
-	cliReader.Discard(int(fN))
-	cli.Write([]byte{0x05, 0x00})
-	cliReader.Discard(1)
-	fCmd = doa.Val(cliReader.ReadByte())
-	cliReader.Discard(1)
-	fAT = doa.Val(cliReader.ReadByte())
-	switch fAT {
-	case 0x01:
-		fDstAddr = make([]byte, 4)
-		io.ReadFull(cliReader, fDstAddr)
-		dstHost = net.IP(fDstAddr).String()
-	case 0x03:
-		fN, _ = cliReader.ReadByte()
-		fDstAddr = make([]byte, int(fN))
-		io.ReadFull(cliReader, fDstAddr)
-		dstHost = string(fDstAddr)
-	case 0x04:
-		fDstAddr = make([]byte, 16)
-		io.ReadFull(cliReader, fDstAddr)
-		dstHost = net.IP(fDstAddr).String()
+	fMethods, err = ReadSocks5Methods(cliReader)
+	if err != nil {
+		return err
+	}
+	// The server selects from one of the methods given in METHODS. If the selected METHOD is X'FF', none of the methods
+	// listed by the client are acceptable, and the client MUST close the connection.
+	fMethod = 0x00
+	if l.Passwd != nil {
+		fMethod = 0x02
 	}
-	_, err = io.ReadFull(cli, fDstPort)
+	if bytes.IndexByte(fMethods, fMethod) == -1 {
+		cli.Write([]byte{0x05, 0xff})
+		return ErrSocksMethod
+	}
+	_, err = cli.Write([]byte{0x05, fMethod})
 	if err != nil {
 		return err
 	}
-	dstPort = binary.BigEndian.Uint16(fDstPort)
-	dst = net.JoinHostPort(dstHost, strconv.Itoa(int(dstPort)))
+	if fMethod == 0x02 {
+		err = l.ServeSocks5Passwd(ctx, cli)
+		if err != nil {
+			return err
+		}
+	}
+	fCmd, dst, err = ReadSocks5Request(cliReader)
+	switch {
+	case errors.Is(err, ErrSocksAddrType):
+		// X'08' Address type not supported.
+		cli.Write([]byte{0x05, 0x08, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return err
+	case errors.Is(err, ErrSocksMalformed) || errors.Is(err, ErrSocksVersion):
+		// X'01' General SOCKS server failure.
+		cli.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return err
+	case err != nil:
+		return err
+	}
+	// The request is served on the raw connection once nothing is left in the read buffer, so that it is able to
+	// splice.
+	if cliReader.Buffered() == 0 {
+		cli = raw
+	}
 	switch fCmd {
 	case 0x01:
 		return l.ServeSocks5TCP(ctx, cli, dst)
 	case 0x02:
-		panic("unreachable")
+		return l.ServeSocks5Bind(ctx, cli, dst)
 	case 0x03:
-		return l.ServeSocks5UDP(ctx, cli)
+		return l.ServeSocks5UDP(ctx, cli, dst)
 	}
-	return nil
+	// X'07' Command not supported.
+	cli.Write([]byte{0x05, 0x07, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	return ErrSocksCommand
 }
 
-// ServeSocks5TCP serves socks5 TCP protocol.
-func (l *Locale) ServeSocks5TCP(ctx *Context, cli io.ReadWriteCloser, dst string) error {
-	log.Printf("conn: %08x  proto format=socks5", ctx.Cid)
-	srv, err := l.Dialer.Dial(ctx, "tcp", dst)
+// ServeSocks5Passwd performs the username/password sub-negotiation.
+//
+// Introduction:
+// See https://datatracker.ietf.org/doc/html/rfc1929
+func (l *Locale) ServeSocks5Passwd(ctx *Context, cli io.ReadWriter) error {
+	// +----+------+----------+------+----------+
+	// |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	// +----+------+----------+------+----------+
+	// | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+	// +----+------+----------+------+----------+
+	var (
+		buf   = make([]byte, 256)
+		err   error
+		fPass []byte
+		fUser []byte
+	)
+	_, err = io.ReadFull(cli, buf[:2])
 	if err != nil {
-		cli.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
-	} else {
-		cli.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
-		// Since the Link function will close the srv, there is no need to close it manually.
+		return err
+	}
+	if buf[0] != 0x01 {
+		return fmt.Errorf("daze: unsupported sub-negotiation version %d", buf[0])
+	}
+	fUser = make([]byte, int(buf[1]))
+	_, err = io.ReadFull(cli, fUser)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(cli, buf[:1])
+	if err != nil {
+		return err
+	}
+	fPass = make([]byte, int(buf[0]))
+	_, err = io.ReadFull(cli, fPass)
+	if err != nil {
+		return err
+	}
+	// A STATUS field of X'00' indicates success. If the server returns a failure (STATUS value other than X'00') status,
+	// it MUST close the connection.
+	if !l.Passwd.Check(string(fUser), string(fPass)) {
+		cli.Write([]byte{0x01, 0x01})
+		return fmt.Errorf("daze: authentication failed user=%s", fUser)
+	}
+	log.Printf("conn: %08x  authn user=%s", ctx.Cid, fUser)
+	_, err = cli.Write([]byte{0x01, 0x00})
+	return err
+}
+
+// ServeSocks5TCP serves socks5 TCP protocol.
+func (l *Locale) ServeSocks5TCP(ctx *Context, cli io.ReadWriteCloser, dst string) error {
+	log.Printf("conn: %08x  proto format=socks5", ctx.Cid)
+	srv, err := l.Dialer.Dial(ctx, "tcp", dst)
+	if err != nil {
+		cli.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	} else {
+		cli.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		// Since the Link function will close the srv, there is no need to close it manually.
 		Link(cli, srv)
 	}
 	return err
 }
 
-// ServeSocks5UDPRead handles the reading and forwarding of udp data.
-func (l *Locale) ServeSocks5UDPRead(srv io.Reader, bnd *net.UDPConn, app *net.UDPAddr, pre []byte) error {
+// ServeSocks5Bind serves socks5 BIND command. Two replies are sent to the client: the first one carries the address
+// of the listener, and the second one is sent when the inbound connection arrives.
+func (l *Locale) ServeSocks5Bind(ctx *Context, cli io.ReadWriteCloser, dst string) error {
+	log.Printf("conn: %08x  proto format=socks5", ctx.Cid)
+	binder, ok := l.Dialer.(Binder)
+	if !ok {
+		// X'07' Command not supported.
+		cli.Write([]byte{0x05, 0x07, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return errors.New("daze: bind is not supported")
+	}
+	bnd, err := binder.Bind(ctx, "tcp", dst)
+	if err != nil {
+		cli.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return err
+	}
+	defer bnd.Close()
+	_, err = cli.Write(append([]byte{0x05, 0x00, 0x00}, Socks5Addr(bnd.Addr())...))
+	if err != nil {
+		return err
+	}
+	srv, rem, err := bnd.Accept()
+	if errors.Is(err, ErrBindPeer) {
+		// X'02' Connection not allowed by ruleset.
+		cli.Write([]byte{0x05, 0x02, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return err
+	}
+	if err != nil {
+		cli.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return err
+	}
+	log.Printf("conn: %08x  bind remote=%s", ctx.Cid, rem)
+	_, err = cli.Write(append([]byte{0x05, 0x00, 0x00}, Socks5Addr(rem)...))
+	if err != nil {
+		srv.Close()
+		return err
+	}
+	Link(cli, srv)
+	return nil
+}
+
+// Socks5Frag is the reassembly queue of socks5 udp fragments. The queue is abandoned when its reassembly timer
+// expires, or when a fragment arrives out of order.
+type Socks5Frag struct {
+	buf []byte
+	dst string
+	exp time.Time
+	pos uint8
+}
+
+// Push appends a fragment to the queue, frag is the FRAG field of the udp request header. The reassembled datagram is
+// returned once the fragment marked as the end of the sequence arrives.
+func (f *Socks5Frag) Push(frag uint8, dst string, data []byte) ([]byte, bool) {
+	// The high-order bit indicates end-of-fragment sequence, while values between 1 and 127 indicate the fragment
+	// position within a fragment sequence.
+	pos := frag & 0x7f
+	if f.pos != 0 && time.Now().After(f.exp) {
+		f.Reset()
+	}
+	// The reassembly queue must be reinitialized and the associated fragments abandoned whenever a new datagram arrives
+	// carrying a FRAG field whose value is less than the highest FRAG value processed for this fragment sequence.
+	if pos <= f.pos {
+		f.Reset()
+	}
+	if pos != f.pos+1 {
+		f.Reset()
+		return nil, false
+	}
+	if pos == 1 {
+		f.dst = dst
+		f.exp = time.Now().Add(Conf.Socks5FragTime)
+	}
+	// Maximum udp payload size is 65507 bytes in ipv4.
+	if dst != f.dst || len(f.buf)+len(data) > 65507 {
+		f.Reset()
+		return nil, false
+	}
+	f.buf = append(f.buf, data...)
+	f.pos = pos
+	if frag&0x80 == 0 {
+		return nil, false
+	}
+	buf := f.buf
+	f.buf = nil
+	f.pos = 0
+	return buf, true
+}
+
+// Reset abandons all queued fragments.
+func (f *Socks5Frag) Reset() {
+	f.buf = nil
+	f.dst = ""
+	f.pos = 0
+}
+
+// ServeSocks5UDPRead handles the reading and forwarding of udp data. Each reply resets the idle timer.
+func (l *Locale) ServeSocks5UDPRead(
+	srv io.Reader, bnd *net.UDPConn, app *net.UDPAddr, pre []byte, ttl *time.Timer,
+) error {
 	var (
-		buf = make([]byte, 2048)
+		// The buffer holds the header and the largest datagram.
+		buf = pool.Get(len(pre) + 65535)
 		err error
 		m   = len(pre)
 		n   int
 	)
+	defer pool.Put(buf)
 	copy(buf[:m], pre)
 	for {
 		n, err = srv.Read(buf[m:])
 		if err != nil {
 			break
 		}
+		ttl.Reset(Conf.Socks5IdleTime)
 		_, err = bnd.WriteToUDP(buf[:m+n], app)
 		if err != nil {
 			break
@@ -475,34 +1317,65 @@ func (l *Locale) ServeSocks5UDPRead(srv io.Reader, bnd *net.UDPConn, app *net.UD
 	return err
 }
 
-// ServeSocks5UDP serves socks5 UDP protocol.
-func (l *Locale) ServeSocks5UDP(ctx *Context, cli io.ReadWriteCloser) error {
+// ServeSocks5UDP serves socks5 UDP protocol. Parameter hint is the DST.ADDR and DST.PORT of the request, which are the
+// address and port that the client expects to use to send datagrams on.
+func (l *Locale) ServeSocks5UDP(ctx *Context, cli io.ReadWriteCloser, hint string) error {
 	var (
 		appAddr     *net.UDPAddr
+		appData     []byte
+		appFrag     = &Socks5Frag{}
+		appFragNum  uint8
 		appHeadSize int
 		appHead     []byte
+		appHost     net.IP
+		appPort     int
 		appSize     int
-		bndAddr     *net.UDPAddr
-		bndPort     uint16
+		bndHost     = net.IPv4(127, 0, 0, 1)
 		bnd         *net.UDPConn
-		buf         = make([]byte, 2048)
+		buf         = pool.Get(65535)
 		cpl         = lru.New[string, io.ReadWriteCloser](Conf.Socks5LruSize)
-		dstHost     string
-		dstPort     uint16
 		dst         string
 		err         error
 		srv         io.ReadWriteCloser
+		ttl         *time.Timer
 	)
-	bndAddr = doa.Try(net.ResolveUDPAddr("udp", "127.0.0.1:0"))
-	bnd = doa.Try(net.ListenUDP("udp", bndAddr))
+	// The relay is bound on the local address that the control connection arrived on, so that it is reachable by
+	// the client. Datagrams are only accepted from the address of the client, unless it is unknown, for example, the
+	// control connection comes from a unix domain socket. Then the relay falls back to loopback, where only local
+	// processes can reach it.
+	loc, rem := NetAddr(cli)
+	if a, ok := loc.(*net.TCPAddr); ok {
+		bndHost = a.IP
+	}
+	if a, ok := rem.(*net.TCPAddr); ok {
+		appHost = a.IP
+	}
+	// https://datatracker.ietf.org/doc/html/rfc1928, Page 7, UDP ASSOCIATE:
+	// If the client is not in possesion of the information at the time of the UDP ASSOCIATE, the client MUST use a
+	// port number and address of all zeros.
+	if host, port, err := net.SplitHostPort(hint); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			appHost = ip
+		}
+		appPort, _ = strconv.Atoi(port)
+	}
+	defer pool.Put(buf)
+	bnd, err = net.ListenUDP("udp", &net.UDPAddr{IP: bndHost})
+	if err != nil {
+		cli.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return err
+	}
 	defer bnd.Close()
-	bndPort = uint16(bnd.LocalAddr().(*net.UDPAddr).Port)
-	copy(buf, []byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
-	binary.BigEndian.PutUint16(buf[8:10], bndPort)
-	_, err = cli.Write(buf[:10])
+	_, err = cli.Write(append([]byte{0x05, 0x00, 0x00}, Socks5Addr(bnd.LocalAddr().String())...))
 	if err != nil {
 		return err
 	}
+	// An association is closed if no datagram has been relayed in either direction for a while.
+	ttl = time.AfterFunc(Conf.Socks5IdleTime, func() {
+		log.Printf("conn: %08x  error daze: udp association is idle", ctx.Cid)
+		bnd.Close()
+	})
+	defer ttl.Stop()
 	cpl.Drop = func(k string, v io.ReadWriteCloser) {
 		v.Close()
 	}
@@ -519,48 +1392,43 @@ func (l *Locale) ServeSocks5UDP(ctx *Context, cli io.ReadWriteCloser) error {
 		if err != nil {
 			break
 		}
-		// 	+----+------+------+----------+----------+----------+
-		// 	|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
-		// 	+----+------+------+----------+----------+----------+
-		// 	| 2  |  1   |  1   | Variable |    2     | Variable |
-		// 	+----+------+------+----------+----------+----------+
-		//  The fields in the UDP request header are:
-		// 	*  RSV                               Reserved  0x0000
-		// 	*  FRAG                       Current fragment number
-		// 	*  ATYP          Address type of following addresses:
-		// 	   *  IP V4 address:                             0x01
-		// 	   *  DOMAINNAME:                                0x03
-		// 	   *  IP V6 address:                             0x04
-		// 	*  DST.ADDR               Desired destination address
-		// 	*  DST.PORT                  Desired destination port
-		// 	*  DATA                                     User data
-		doa.Doa(buf[0] == 0x00)
-		doa.Doa(buf[1] == 0x00)
-		// Implementation of fragmentation is optional; an implementation that does not support fragmentation MUST drop
-		// any datagram whose FRAG field is other than X'00'.
-		doa.Doa(buf[2] == 0x00)
-		switch buf[3] {
-		case 0x01:
-			appHeadSize = 10
-		case 0x03:
-			appHeadSize = int(buf[4]) + 7
-		case 0x04:
-			appHeadSize = 22
-		}
-		appHead = buf[0:appHeadSize]
-		switch appHead[3] {
-		case 0x01:
-			dstHost = net.IP(appHead[4:8]).String()
-			dstPort = binary.BigEndian.Uint16(appHead[8:10])
-		case 0x03:
-			l := appHead[4]
-			dstHost = string(appHead[5 : 5+l])
-			dstPort = binary.BigEndian.Uint16(appHead[5+l : 7+l])
-		case 0x04:
-			dstHost = net.IP(appHead[4:20]).String()
-			dstPort = binary.BigEndian.Uint16(appHead[20:22])
-		}
-		dst = dstHost + ":" + strconv.Itoa(int(dstPort))
+		if (appHost != nil && !appHost.Equal(appAddr.IP)) || (appPort != 0 && appPort != appAddr.Port) {
+			log.Printf("conn: %08x  error daze: unexpected udp source %s", ctx.Cid, appAddr)
+			continue
+		}
+		if !l.Access.Check(appAddr) {
+			log.Printf("conn: %08x  error daze: %s is denied", ctx.Cid, appAddr)
+			Expv.LocaleDeny.Add(1)
+			continue
+		}
+		ttl.Reset(Conf.Socks5IdleTime)
+		// The fields in the UDP request header are:
+		// *  RSV                               Reserved  0x0000
+		// *  FRAG                       Current fragment number
+		// *  ATYP          Address type of following addresses:
+		//    *  IP V4 address:                             0x01
+		//    *  DOMAINNAME:                                0x03
+		//    *  IP V6 address:                             0x04
+		// *  DST.ADDR               Desired destination address
+		// *  DST.PORT                  Desired destination port
+		// *  DATA                                     User data
+		// There is no way to reply an error for a udp request, so malformed datagrams are simply dropped.
+		appFragNum, dst, appHeadSize, err = ParseSocks5UDP(buf[:appSize])
+		if err != nil {
+			log.Printf("conn: %08x  error %s", ctx.Cid, err)
+			continue
+		}
+		appHead = buf[:appHeadSize]
+		appData = buf[appHeadSize:appSize]
+		// A datagram whose FRAG field is other than X'00' is one of a number of fragments. It is queued, and nothing is
+		// forwarded until the fragment sequence completes.
+		if appFragNum != 0x00 {
+			data, ok := appFrag.Push(appFragNum, dst, appData)
+			if !ok {
+				continue
+			}
+			appData = data
+		}
 		if !cpl.Has(dst) {
 			log.Printf("conn: %08x  proto format=socks5", ctx.Cid)
 			srv, err = l.Dialer.Dial(ctx, "udp", dst)
@@ -569,10 +1437,13 @@ func (l *Locale) ServeSocks5UDP(ctx *Context, cli io.ReadWriteCloser) error {
 				continue
 			}
 			cpl.Set(dst, srv)
-			go l.ServeSocks5UDPRead(srv, bnd, appAddr, appHead)
+			// The header is reused by every reply, replies are never fragmented.
+			pre := bytes.Clone(appHead)
+			pre[2] = 0x00
+			go l.ServeSocks5UDPRead(srv, bnd, appAddr, pre, ttl)
 		}
 		srv = cpl.Get(dst)
-		_, err = srv.Write(buf[appHeadSize:appSize])
+		_, err = srv.Write(appData)
 		if err != nil {
 			log.Printf("conn: %08x  error %s", ctx.Cid, err)
 			cpl.Del(dst)
@@ -601,39 +1472,847 @@ func (l *Locale) Serve(ctx *Context, cli io.ReadWriteCloser) error {
 		}
 		return err
 	}
-	cli = &ReadWriteCloser{
-		Reader: io.MultiReader(bytes.NewReader(buf), cli),
-		Writer: cli,
-		Closer: cli,
-	}
+	cli = &PrefixConn{ReadWriteCloser: cli, Prefix: buf}
 	if buf[0] == 0x05 {
 		return l.ServeSocks5(ctx, cli)
 	}
 	if buf[0] == 0x04 {
 		return l.ServeSocks4(ctx, cli)
 	}
-	return l.ServeProxy(ctx, cli)
+	return l.ServeProxy(ctx, cli)
+}
+
+// Errors returned by the socks parsers when a client sends a malformed request. No matter what the client sends, the
+// parsers never panic, the locale replies with the corresponding failure code and closes the connection instead.
+var (
+	ErrSocksAddrType  = errors.New("daze: address type not supported")
+	ErrSocksCommand   = errors.New("daze: command not supported")
+	ErrSocksMalformed = errors.New("daze: malformed request")
+	ErrSocksMethod    = errors.New("daze: no acceptable methods")
+	ErrSocksVersion   = errors.New("daze: version not supported")
+)
+
+// ReadSocks4Request reads a socks4 or socks4a request, returns the command code and the destination address.
+//
+// +----+----+----+----+----+----+----+----+----+----+....+----+
+// | VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+// +----+----+----+----+----+----+----+----+----+----+....+----+
+// | 1  | 1  |    2    |         4         | variable     | 1  |
+// +----+----+----+----+----+----+----+----+----+----+....+----+
+func ReadSocks4Request(r *bufio.Reader) (uint8, string, error) {
+	buf := make([]byte, 8)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return 0, "", err
+	}
+	if buf[0] != 0x04 {
+		return 0, "", ErrSocksVersion
+	}
+	// The userid and hostname are read with ReadSlice, so their length is limited by the size of the buffer of r.
+	_, err = r.ReadSlice(0x00)
+	if err != nil {
+		return 0, "", errors.Join(ErrSocksMalformed, err)
+	}
+	host := net.IP(buf[4:8]).String()
+	// Socks4a: the client sets the first three bytes of DSTIP to NULL and the last byte to a non-zero value, and sends
+	// the domain name after the NULL byte terminating the USERID field.
+	if bytes.Equal(buf[4:7], []byte{0x00, 0x00, 0x00}) && buf[7] != 0x00 {
+		name, err := r.ReadSlice(0x00)
+		if err != nil {
+			return 0, "", errors.Join(ErrSocksMalformed, err)
+		}
+		if len(name) == 1 {
+			return 0, "", ErrSocksMalformed
+		}
+		host = string(name[:len(name)-1])
+	}
+	return buf[1], net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[2:4])))), nil
+}
+
+// ReadSocks5Methods reads the version identifier/method selection message of socks5, returns the methods.
+//
+// +----+----------+----------+
+// |VER | NMETHODS | METHODS  |
+// +----+----------+----------+
+// | 1  |    1     | 1 to 255 |
+// +----+----------+----------+
+func ReadSocks5Methods(r io.Reader) ([]byte, error) {
+	buf := make([]byte, 2)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	if buf[0] != 0x05 {
+		return nil, ErrSocksVersion
+	}
+	buf = make([]byte, buf[1])
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// ReadSocks5Request reads a socks5 request, returns the command and the destination address.
+//
+// +----+-----+-------+------+----------+----------+
+// |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+// +----+-----+-------+------+----------+----------+
+// | 1  |  1  | X'00' |  1   | Variable |    2     |
+// +----+-----+-------+------+----------+----------+
+func ReadSocks5Request(r io.Reader) (uint8, string, error) {
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return 0, "", err
+	}
+	if buf[0] != 0x05 {
+		return 0, "", ErrSocksVersion
+	}
+	var (
+		cmd  = buf[1]
+		head = []byte{buf[3]}
+		n    int
+	)
+	// The length of the rest of the address depends on ATYP.
+	switch buf[3] {
+	case 0x01:
+		n = 4 + 2
+	case 0x03:
+		_, err = io.ReadFull(r, buf[:1])
+		if err != nil {
+			return 0, "", err
+		}
+		head = append(head, buf[0])
+		n = int(buf[0]) + 2
+	case 0x04:
+		n = 16 + 2
+	default:
+		return 0, "", ErrSocksAddrType
+	}
+	addr := make([]byte, len(head)+n)
+	copy(addr, head)
+	_, err = io.ReadFull(r, addr[len(head):])
+	if err != nil {
+		return 0, "", err
+	}
+	dst, _, err := ParseSocks5Addr(addr)
+	return cmd, dst, err
+}
+
+// ParseSocks5Addr parses the ATYP, ADDR and PORT fields of socks5. It returns the address in host:port form and the
+// number of bytes consumed.
+func ParseSocks5Addr(b []byte) (string, int, error) {
+	var (
+		host string
+		n    int
+	)
+	if len(b) < 1 {
+		return "", 0, ErrSocksMalformed
+	}
+	switch b[0] {
+	case 0x01:
+		n = 1 + 4 + 2
+		if len(b) < n {
+			return "", 0, ErrSocksMalformed
+		}
+		host = net.IP(b[1:5]).String()
+	case 0x03:
+		if len(b) < 2 || b[1] == 0 {
+			return "", 0, ErrSocksMalformed
+		}
+		n = 1 + 1 + int(b[1]) + 2
+		if len(b) < n {
+			return "", 0, ErrSocksMalformed
+		}
+		host = string(b[2 : 2+int(b[1])])
+	case 0x04:
+		n = 1 + 16 + 2
+		if len(b) < n {
+			return "", 0, ErrSocksMalformed
+		}
+		host = net.IP(b[1:17]).String()
+	default:
+		return "", 0, ErrSocksAddrType
+	}
+	port := binary.BigEndian.Uint16(b[n-2 : n])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), n, nil
+}
+
+// ParseSocks5UDP parses the header of a socks5 udp request. It returns the FRAG field, the destination address and
+// the size of the header.
+//
+// +----+------+------+----------+----------+----------+
+// |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+// +----+------+------+----------+----------+----------+
+// | 2  |  1   |  1   | Variable |    2     | Variable |
+// +----+------+------+----------+----------+----------+
+func ParseSocks5UDP(b []byte) (uint8, string, int, error) {
+	if len(b) < 4 {
+		return 0, "", 0, ErrSocksMalformed
+	}
+	if b[0] != 0x00 || b[1] != 0x00 {
+		return 0, "", 0, ErrSocksMalformed
+	}
+	dst, n, err := ParseSocks5Addr(b[3:])
+	if err != nil {
+		return 0, "", 0, err
+	}
+	return b[2], dst, 3 + n, nil
+}
+
+// Socks5Addr encodes an address in host:port form into the ATYP, ADDR and PORT fields of socks5. An unparsable address
+// is encoded as 0.0.0.0:0.
+func Socks5Addr(address string) []byte {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return []byte{0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	}
+	p, _ := strconv.Atoi(port)
+	ip := net.ParseIP(host)
+	var buf []byte
+	switch {
+	case ip != nil && ip.To4() != nil:
+		buf = append([]byte{0x01}, ip.To4()...)
+	case ip != nil:
+		buf = append([]byte{0x04}, ip.To16()...)
+	case len(host) <= 255:
+		buf = append([]byte{0x03, uint8(len(host))}, host...)
+	default:
+		buf = []byte{0x01, 0x00, 0x00, 0x00, 0x00}
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(p))
+}
+
+// Close listener.
+func (l *Locale) Close() error {
+	if l.Closer != nil {
+		return l.Closer.Close()
+	}
+	return nil
+}
+
+// Run it.
+func (l *Locale) Run() error {
+	network, address := "tcp", l.Listen
+	if path, ok := strings.CutPrefix(l.Listen, "unix:"); ok {
+		network, address = "unix", path
+		// A socket file left behind by a crashed process makes the listen fail. Remove it, but never a regular file.
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+	}
+	s, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	if network == "unix" && l.Chmode != 0 {
+		if err := os.Chmod(address, l.Chmode); err != nil {
+			s.Close()
+			return err
+		}
+	}
+	if l.Secure != nil {
+		// The handshake is done lazily on the first read, so a slow client never blocks the accept loop.
+		s = tls.NewListener(s, l.Secure)
+	}
+	l.Closer = s
+	log.Println("main: listen and serve on", l.Listen)
+
+	go func() {
+		idx := uint32(math.MaxUint32)
+		for {
+			cli, err := s.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Println("main:", err)
+				}
+				break
+			}
+			idx++
+			ctx := &Context{Cid: idx}
+			log.Printf("conn: %08x accept remote=%s", ctx.Cid, cli.RemoteAddr())
+			if !l.Access.Check(cli.RemoteAddr()) {
+				log.Printf("conn: %08x  error daze: %s is denied", ctx.Cid, cli.RemoteAddr())
+				Expv.LocaleDeny.Add(1)
+				cli.Close()
+				continue
+			}
+			go func() {
+				defer cli.Close()
+				if err := l.Serve(ctx, cli); err != nil {
+					log.Printf("conn: %08x  error %s", ctx.Cid, err)
+				}
+				log.Printf("conn: %08x closed", ctx.Cid)
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// NewLocale returns a Locale.
+func NewLocale(listen string, dialer Dialer) *Locale {
+	return &Locale{
+		Dialer: dialer,
+		Listen: listen,
+	}
+}
+
+// NewLocaleMulti returns a locale for each address in the comma separated list, all of them share the dialer. Each
+// address may be followed by options in query string format, which are the access policy of its own locale:
+//
+//	auth=false  serve without authentication, even if the passwd is not nil
+//	mode=0660   permission bits of the unix domain socket file
+//	cert=path   pem encoded certificate chain, the locale serves over tls if it is given together with a key
+//	key=path    pem encoded private key
+//	allow=cidr  only clients in the cidr are allowed, it can be given multiple times
+//	deny=cidr   clients in the cidr are denied, it can be given multiple times
+//
+// Examples:
+// 127.0.0.1:1080?auth=false,0.0.0.0:1080,unix:/run/daze.sock?mode=0660
+// 0.0.0.0:1443?cert=/etc/daze/cert.pem&key=/etc/daze/key.pem
+// 0.0.0.0:1080?allow=192.168.1.0/24&allow=10.0.0.0/8&deny=192.168.1.13
+func NewLocaleMulti(list string, dialer Dialer, passwd *Passwd) []*Locale {
+	r := []*Locale{}
+	for _, e := range strings.Split(list, ",") {
+		listen, query, _ := strings.Cut(e, "?")
+		value := doa.Try(url.ParseQuery(query))
+		locale := NewLocale(listen, dialer)
+		locale.Passwd = passwd
+		if value.Has("auth") && !doa.Try(strconv.ParseBool(value.Get("auth"))) {
+			locale.Passwd = nil
+		}
+		if value.Has("mode") {
+			locale.Chmode = os.FileMode(doa.Try(strconv.ParseUint(value.Get("mode"), 8, 32)))
+		}
+		if value.Has("cert") || value.Has("key") {
+			cert := doa.Try(tls.LoadX509KeyPair(value.Get("cert"), value.Get("key")))
+			locale.Secure = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		}
+		if value.Has("allow") || value.Has("deny") {
+			locale.Access = NewAccess(value["allow"], value["deny"])
+		}
+		r = append(r, locale)
+	}
+	return r
+}
+
+// Redirect is a transparent tcp proxy. It serves connections redirected to it by iptables or nftables, recovers their
+// original destinations and dials them through the dialer, so there is no need to configure a proxy for each app.
+//
+// Examples:
+// iptables -t nat -A OUTPUT -p tcp -m owner ! --uid-owner daze -j REDIRECT --to-ports 1082
+type Redirect struct {
+	Closer io.Closer
+	Dialer Dialer
+	Listen string
+}
+
+// Serve serves incoming connections. Parameter cli will be closed automatically when the function exits.
+func (r *Redirect) Serve(ctx *Context, cli *net.TCPConn) error {
+	dst, err := OriginalDst(cli)
+	if err != nil {
+		return err
+	}
+	// A connection made to the listener directly has itself as the original destination, dialing it leads to a loop.
+	if dst == cli.LocalAddr().String() {
+		return errors.New("daze: connection is not redirected")
+	}
+	log.Printf("conn: %08x  proto format=redirect", ctx.Cid)
+	srv, err := r.Dialer.Dial(ctx, "tcp", dst)
+	if err != nil {
+		return err
+	}
+	Link(cli, srv)
+	return nil
+}
+
+// Close listener.
+func (r *Redirect) Close() error {
+	if r.Closer != nil {
+		return r.Closer.Close()
+	}
+	return nil
+}
+
+// Run it.
+func (r *Redirect) Run() error {
+	s, err := net.Listen("tcp", r.Listen)
+	if err != nil {
+		return err
+	}
+	r.Closer = s
+	log.Println("main: listen and serve on", r.Listen)
+
+	go func() {
+		idx := uint32(math.MaxUint32)
+		for {
+			cli, err := s.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Println("main:", err)
+				}
+				break
+			}
+			idx++
+			ctx := &Context{Cid: idx}
+			log.Printf("conn: %08x accept remote=%s", ctx.Cid, cli.RemoteAddr())
+			go func() {
+				defer cli.Close()
+				if err := r.Serve(ctx, cli.(*net.TCPConn)); err != nil {
+					log.Printf("conn: %08x  error %s", ctx.Cid, err)
+				}
+				log.Printf("conn: %08x closed", ctx.Cid)
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// NewRedirect returns a Redirect.
+func NewRedirect(listen string, dialer Dialer) *Redirect {
+	return &Redirect{
+		Dialer: dialer,
+		Listen: listen,
+	}
+}
+
+// Tproxy is a transparent udp proxy. It receives datagrams diverted to it by the TPROXY target of iptables, recovers
+// their original destinations and relays them through the dialer. Replies are sent back with the original destination
+// as their source address.
+//
+// Examples:
+// ip rule add fwmark 1 lookup 100
+// ip route add local 0.0.0.0/0 dev lo table 100
+// iptables -t mangle -A PREROUTING -p udp -j TPROXY --on-port 1083 --tproxy-mark 1
+type Tproxy struct {
+	Closer io.Closer
+	Dialer Dialer
+	Listen string
+}
+
+// TproxyFlow is a udp flow between a source address and an original destination address.
+type TproxyFlow struct {
+	rep *net.UDPConn
+	srv io.ReadWriteCloser
+	ttl *time.Timer
+}
+
+// Serve serves incoming datagrams. It returns when parameter cli is closed.
+func (t *Tproxy) Serve(cli *net.UDPConn) error {
+	var (
+		buf = pool.Get(65535)
+		cpl = lru.New[string, *TproxyFlow](Conf.TproxyLruSize)
+		dst *net.UDPAddr
+		err error
+		idx = uint32(math.MaxUint32)
+		n   int
+		src *net.UDPAddr
+	)
+	defer pool.Put(buf)
+	cpl.Drop = func(k string, v *TproxyFlow) {
+		v.ttl.Stop()
+		v.srv.Close()
+		v.rep.Close()
+	}
+	// Removes the flow only if it has not been replaced by a new one under the same key.
+	del := func(k string, f *TproxyFlow) {
+		if v, ok := cpl.GetExists(k); ok && v == f {
+			cpl.Del(k)
+		}
+	}
+	for {
+		n, src, dst, err = ReadFromTproxy(cli, buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			log.Println("main:", err)
+			continue
+		}
+		key := src.String() + "-" + dst.String()
+		f, ok := cpl.GetExists(key)
+		if !ok {
+			idx++
+			ctx := &Context{Cid: idx}
+			log.Printf("conn: %08x accept remote=%s", ctx.Cid, src)
+			log.Printf("conn: %08x  proto format=tproxy", ctx.Cid)
+			srv, err := t.Dialer.Dial(ctx, "udp", dst.String())
+			if err != nil {
+				log.Printf("conn: %08x  error %s", ctx.Cid, err)
+				continue
+			}
+			rep, err := DialTproxy(dst, src)
+			if err != nil {
+				log.Printf("conn: %08x  error %s", ctx.Cid, err)
+				srv.Close()
+				continue
+			}
+			f = &TproxyFlow{rep: rep, srv: srv}
+			f.ttl = time.AfterFunc(Conf.TproxyTimeout, func() {
+				del(key, f)
+			})
+			cpl.Set(key, f)
+			go func() {
+				b := pool.Get(65535)
+				defer pool.Put(b)
+				for {
+					n, err := f.srv.Read(b)
+					if err != nil {
+						break
+					}
+					f.ttl.Reset(Conf.TproxyTimeout)
+					_, err = f.rep.Write(b[:n])
+					if err != nil {
+						break
+					}
+				}
+				del(key, f)
+				log.Printf("conn: %08x closed", ctx.Cid)
+			}()
+		}
+		f.ttl.Reset(Conf.TproxyTimeout)
+		_, err = f.srv.Write(buf[:n])
+		if err != nil {
+			log.Println("main:", err)
+			del(key, f)
+		}
+	}
+	// Flows are also removed by their own goroutines, so take a snapshot of the keys first.
+	cpl.M.Lock()
+	key := make([]string, 0, len(cpl.C))
+	for k := range cpl.C {
+		key = append(key, k)
+	}
+	cpl.M.Unlock()
+	for _, k := range key {
+		cpl.Del(k)
+	}
+	return nil
+}
+
+// Close listener.
+func (t *Tproxy) Close() error {
+	if t.Closer != nil {
+		return t.Closer.Close()
+	}
+	return nil
+}
+
+// Run it.
+func (t *Tproxy) Run() error {
+	s, err := ListenTproxy(t.Listen)
+	if err != nil {
+		return err
+	}
+	t.Closer = s
+	log.Println("main: listen and serve on", t.Listen)
+
+	go func() {
+		if err := t.Serve(s); err != nil {
+			log.Println("main:", err)
+		}
+	}()
+
+	return nil
+}
+
+// NewTproxy returns a Tproxy.
+func NewTproxy(listen string, dialer Dialer) *Tproxy {
+	return &Tproxy{
+		Dialer: dialer,
+		Listen: listen,
+	}
+}
+
+// Tun is a tun device proxy. It terminates the tcp and udp flows of the tun device by a userspace network stack and
+// relays them through the dialer, so that it captures every app on the machine, including those ignore proxy settings.
+// The device must be brought up, addressed and routed by the user.
+//
+// Examples:
+// ip tuntap add mode tun dev daze0
+// ip addr add 198.18.0.1/15 dev daze0
+// ip link set dev daze0 up
+// ip route add default dev daze0 table 100
+// ip rule add not uidrange 0-0 lookup 100
+type Tun struct {
+	Closer io.Closer
+	Dialer Dialer
+	Listen string
+}
+
+// ServeTCP serves a tcp flow to dst. Parameter cli will be closed automatically when the function exits.
+func (t *Tun) ServeTCP(ctx *Context, cli io.ReadWriteCloser, dst string) error {
+	log.Printf("conn: %08x  proto format=tun", ctx.Cid)
+	srv, err := t.Dialer.Dial(ctx, "tcp", dst)
+	if err != nil {
+		return err
+	}
+	Link(cli, srv)
+	return nil
+}
+
+// ServeUDP serves a udp flow to dst, every read and write on parameter cli is a datagram. The flow is closed if no
+// datagram has been relayed in either direction for Conf.TproxyTimeout.
+func (t *Tun) ServeUDP(ctx *Context, cli io.ReadWriteCloser, dst string) error {
+	log.Printf("conn: %08x  proto format=tun", ctx.Cid)
+	srv, err := t.Dialer.Dial(ctx, "udp", dst)
+	if err != nil {
+		return err
+	}
+	defer srv.Close()
+	ttl := time.AfterFunc(Conf.TproxyTimeout, func() {
+		cli.Close()
+		srv.Close()
+	})
+	defer ttl.Stop()
+	go func() {
+		b := pool.Get(65535)
+		defer pool.Put(b)
+		for {
+			n, err := srv.Read(b)
+			if err != nil {
+				break
+			}
+			ttl.Reset(Conf.TproxyTimeout)
+			_, err = cli.Write(b[:n])
+			if err != nil {
+				break
+			}
+		}
+		cli.Close()
+	}()
+	b := pool.Get(65535)
+	defer pool.Put(b)
+	for {
+		n, err := cli.Read(b)
+		if err != nil {
+			break
+		}
+		ttl.Reset(Conf.TproxyTimeout)
+		_, err = srv.Write(b[:n])
+		if err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Close listener.
+func (t *Tun) Close() error {
+	if t.Closer != nil {
+		return t.Closer.Close()
+	}
+	return nil
+}
+
+// Run it.
+func (t *Tun) Run() error {
+	c, err := ListenTun(t)
+	if err != nil {
+		return err
+	}
+	t.Closer = c
+	log.Println("main: listen and serve on", t.Listen)
+	return nil
+}
+
+// NewTun returns a Tun. Parameter name is the name of the tun device.
+func NewTun(name string, dialer Dialer) *Tun {
+	return &Tun{
+		Dialer: dialer,
+		Listen: name,
+	}
+}
+
+// Dnserv is a dns server over udp and tcp. Each query is routed by its name: A and AAAA queries for names on the locale
+// road are resolved by net.DefaultResolver, names on the fucked road are answered with NXDOMAIN, and all the others are
+// forwarded through the dialer to the remote resolver as udp datagrams, so apps leak no queries for remote names.
+//
+// If Fakeip is set, A queries for names on the remote road are answered with fake ips instead, and AAAA queries with
+// empty answers, so the names can be restored from the destinations of transparent connections.
+type Dnserv struct {
+	Closer io.Closer
+	Dialer Dialer
+	Fakeip *Fakeip
+	Listen string
+	Remote string
+	Router Router
+}
+
+// Exchange answers a dns query message.
+func (d *Dnserv) Exchange(ctx *Context, req []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(req)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(q.Name.String(), ".")
+	log.Printf("conn: %08x  query name=%s type=%s", ctx.Cid, name, q.Type)
+	tag := d.Router.Road(ctx, name)
+	log.Printf("conn: %08x  route road=%s", ctx.Cid, tag)
+	switch {
+	case tag == RoadLocale && (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA):
+		return d.ExchangeLocale(ctx, h, q)
+	case tag == RoadFucked:
+		return DnservReply(h, q, dnsmessage.RCodeNameError, nil, 0)
+	case tag != RoadLocale && d.Fakeip != nil && q.Type == dnsmessage.TypeA:
+		ip := d.Fakeip.Alloc(name)
+		log.Printf("conn: %08x  fakeip addr=%s", ctx.Cid, ip)
+		return DnservReply(h, q, dnsmessage.RCodeSuccess, []netip.Addr{ip}, Conf.FakeipTTL)
+	case tag != RoadLocale && d.Fakeip != nil && q.Type == dnsmessage.TypeAAAA:
+		return DnservReply(h, q, dnsmessage.RCodeSuccess, nil, 0)
+	}
+	rep, err := d.ExchangeRemote(ctx, req)
+	if err != nil {
+		log.Printf("conn: %08x  error %s", ctx.Cid, err)
+		return DnservReply(h, q, dnsmessage.RCodeServerFailure, nil, 0)
+	}
+	return rep, nil
+}
+
+// ExchangeLocale answers an A or AAAA query by net.DefaultResolver.
+func (d *Dnserv) ExchangeLocale(ctx *Context, h dnsmessage.Header, q dnsmessage.Question) ([]byte, error) {
+	network := "ip4"
+	if q.Type == dnsmessage.TypeAAAA {
+		network = "ip6"
+	}
+	name := strings.TrimSuffix(q.Name.String(), ".")
+	ips, err := net.DefaultResolver.LookupNetIP(context.Background(), network, name)
+	if err != nil {
+		// Go reports no such host even if the name only has records of another type, so an empty answer is returned
+		// instead of NXDOMAIN.
+		var dnsError *net.DNSError
+		if errors.As(err, &dnsError) && dnsError.IsNotFound {
+			return DnservReply(h, q, dnsmessage.RCodeSuccess, nil, 0)
+		}
+		log.Printf("conn: %08x  error %s", ctx.Cid, err)
+		return DnservReply(h, q, dnsmessage.RCodeServerFailure, nil, 0)
+	}
+	return DnservReply(h, q, dnsmessage.RCodeSuccess, ips, Conf.DnservTTL)
+}
+
+// ExchangeRemote forwards a dns query message through the dialer to the remote resolver.
+func (d *Dnserv) ExchangeRemote(ctx *Context, req []byte) ([]byte, error) {
+	srv, err := d.Dialer.Dial(ctx, "udp", d.Remote)
+	if err != nil {
+		return nil, err
+	}
+	defer srv.Close()
+	// Udp has no way to report a lost datagram, give up when the remote resolver does not reply in time.
+	ttl := time.AfterFunc(Conf.DialerTimeout, func() {
+		srv.Close()
+	})
+	defer ttl.Stop()
+	_, err = srv.Write(req)
+	if err != nil {
+		return nil, err
+	}
+	buf := pool.Get(65535)
+	defer pool.Put(buf)
+	n, err := srv.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	// The reply outlives the buffer, it is copied out at its own size.
+	return bytes.Clone(buf[:n]), nil
+}
+
+// ServeUDP serves a query received over udp, the reply is sent back to the source address.
+func (d *Dnserv) ServeUDP(ctx *Context, cli *net.UDPConn, src *net.UDPAddr, req []byte) error {
+	rep, err := d.Exchange(ctx, req)
+	if err != nil {
+		return err
+	}
+	_, err = cli.WriteToUDP(rep, src)
+	return err
+}
+
+// ServeTCP serves incoming queries over tcp. Parameter cli will be closed automatically when the function exits.
+func (d *Dnserv) ServeTCP(ctx *Context, cli io.ReadWriteCloser) error {
+	buf := pool.Get(65535)
+	defer pool.Put(buf)
+	for {
+		// Messages sent over tcp connections use a 2 byte length prefix, see rfc 1035 4.2.2.
+		_, err := io.ReadFull(cli, buf[:2])
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		n := binary.BigEndian.Uint16(buf[:2])
+		_, err = io.ReadFull(cli, buf[:n])
+		if err != nil {
+			return err
+		}
+		rep, err := d.Exchange(ctx, buf[:n])
+		if err != nil {
+			return err
+		}
+		// A message over udp never exceeds 65535 bytes, so does the reply.
+		_, err = cli.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(rep))), rep...))
+		if err != nil {
+			return err
+		}
+	}
 }
 
 // Close listener.
-func (l *Locale) Close() error {
-	if l.Closer != nil {
-		return l.Closer.Close()
+func (d *Dnserv) Close() error {
+	if d.Closer != nil {
+		return d.Closer.Close()
 	}
 	return nil
 }
 
 // Run it.
-func (l *Locale) Run() error {
-	s, err := net.Listen("tcp", l.Listen)
+func (d *Dnserv) Run() error {
+	u, err := net.ListenPacket("udp", d.Listen)
 	if err != nil {
 		return err
 	}
-	l.Closer = s
-	log.Println("main: listen and serve on", l.Listen)
+	s, err := net.Listen("tcp", d.Listen)
+	if err != nil {
+		u.Close()
+		return err
+	}
+	d.Closer = MultiCloser{u, s}
+	log.Println("main: listen and serve on", d.Listen)
+
+	// Queries over udp and tcp share the same id space.
+	idx := atomic.Uint32{}
+
+	go func() {
+		for {
+			buf := pool.Get(2048)
+			n, src, err := u.(*net.UDPConn).ReadFromUDP(buf)
+			if err != nil {
+				pool.Put(buf)
+				if !errors.Is(err, net.ErrClosed) {
+					log.Println("main:", err)
+				}
+				break
+			}
+			ctx := &Context{Cid: idx.Add(1) - 1}
+			log.Printf("conn: %08x accept remote=%s", ctx.Cid, src)
+			go func() {
+				// The query is owned by the goroutine, and is put back once it is served.
+				defer pool.Put(buf)
+				if err := d.ServeUDP(ctx, u.(*net.UDPConn), src, buf[:n]); err != nil {
+					log.Printf("conn: %08x  error %s", ctx.Cid, err)
+				}
+			}()
+		}
+	}()
 
 	go func() {
-		idx := uint32(math.MaxUint32)
 		for {
 			cli, err := s.Accept()
 			if err != nil {
@@ -642,12 +2321,11 @@ func (l *Locale) Run() error {
 				}
 				break
 			}
-			idx++
-			ctx := &Context{idx}
+			ctx := &Context{Cid: idx.Add(1) - 1}
 			log.Printf("conn: %08x accept remote=%s", ctx.Cid, cli.RemoteAddr())
 			go func() {
 				defer cli.Close()
-				if err := l.Serve(ctx, cli); err != nil {
+				if err := d.ServeTCP(ctx, cli); err != nil {
 					log.Printf("conn: %08x  error %s", ctx.Cid, err)
 				}
 				log.Printf("conn: %08x closed", ctx.Cid)
@@ -658,12 +2336,113 @@ func (l *Locale) Run() error {
 	return nil
 }
 
-// NewLocale returns a Locale.
-func NewLocale(listen string, dialer Dialer) *Locale {
-	return &Locale{
+// NewDnserv returns a Dnserv.
+func NewDnserv(listen string, dialer Dialer, remote string, router Router) *Dnserv {
+	return &Dnserv{
 		Dialer: dialer,
 		Listen: listen,
+		Remote: remote,
+		Router: router,
+	}
+}
+
+// Fakeip allocates fake ips from a reserved pool for names, and restores names from fake ips. It is safe for concurrent
+// access.
+type Fakeip struct {
+	// Addr maps fake ips to names, and evicts the least recently used one.
+	Addr *lru.Lru[netip.Addr, string]
+	// Name maps names to fake ips, it is kept in sync with Addr.
+	Name map[string]netip.Addr
+	Next netip.Addr
+	Pool netip.Prefix
+	M    *sync.Mutex
+}
+
+// Alloc returns the fake ip of the name, a new one is allocated if the name is not mapped yet.
+func (f *Fakeip) Alloc(name string) netip.Addr {
+	f.M.Lock()
+	defer f.M.Unlock()
+	if ip, ok := f.Name[name]; ok {
+		f.Addr.Get(ip)
+		return ip
+	}
+	// Addresses are allocated in a round robin, and those still in use are skipped. The pool is larger than the cache,
+	// so a free address is always found.
+	for f.Addr.Has(f.Next) {
+		f.Next = f.next(f.Next)
+	}
+	ip := f.Next
+	f.Next = f.next(f.Next)
+	f.Addr.Set(ip, name)
+	f.Name[name] = ip
+	return ip
+}
+
+// Contains reports whether the ip is in the fake ip pool.
+func (f *Fakeip) Contains(ip netip.Addr) bool {
+	return f.Pool.Contains(ip.Unmap())
+}
+
+// Lookup returns the name mapped to the fake ip.
+func (f *Fakeip) Lookup(ip netip.Addr) (string, bool) {
+	f.M.Lock()
+	defer f.M.Unlock()
+	return f.Addr.GetExists(ip.Unmap())
+}
+
+// The network address and the broadcast address of the pool are never allocated.
+func (f *Fakeip) next(ip netip.Addr) netip.Addr {
+	ip = ip.Next()
+	if !f.Pool.Contains(ip) || !f.Pool.Contains(ip.Next()) {
+		ip = f.Pool.Addr().Next()
+	}
+	return ip
+}
+
+// NewFakeip returns a new Fakeip. Parameter pool is a cidr, for example, 198.18.0.0/15.
+func NewFakeip(pool string) *Fakeip {
+	prefix := doa.Try(netip.ParsePrefix(pool)).Masked()
+	doa.Doa(prefix.Addr().Is4())
+	doa.Doa(prefix.Bits() <= 30)
+	f := &Fakeip{
+		Addr: lru.New[netip.Addr, string](min(Conf.FakeipLruSize, 1<<(32-prefix.Bits())-3)),
+		Name: map[string]netip.Addr{},
+		Next: prefix.Addr().Next(),
+		Pool: prefix,
+		M:    &sync.Mutex{},
+	}
+	f.Addr.Drop = func(k netip.Addr, v string) {
+		delete(f.Name, v)
+	}
+	return f
+}
+
+// DnservReply builds a reply of the query with the rcode and the ip addresses as answers.
+func DnservReply(h dnsmessage.Header, q dnsmessage.Question, code dnsmessage.RCode, ips []netip.Addr, ttl uint32) ([]byte, error) {
+	h.Response = true
+	h.Authoritative = false
+	h.RecursionAvailable = true
+	h.RCode = code
+	b := dnsmessage.NewBuilder(nil, h)
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		r := dnsmessage.ResourceHeader{
+			Name:  q.Name,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		}
+		switch {
+		case q.Type == dnsmessage.TypeA && ip.Is4():
+			b.AResource(r, dnsmessage.AResource{A: ip.As4()})
+		case q.Type == dnsmessage.TypeAAAA && ip.Is6():
+			b.AAAAResource(r, dnsmessage.AAAAResource{AAAA: ip.As16()})
+		}
 	}
+	return b.Finish()
 }
 
 // ============================================================================
@@ -710,24 +2489,152 @@ func (r Road) String() string {
 
 // Router is a selector that will judge the host address.
 type Router interface {
-	// The host must be a literal IP address, or a host name that can be resolved to IP addresses.
+	// The host must be a literal IP address, or a host name that can be resolved to IP addresses. The ctx must not be
+	// nil, routers report the ip and the error met in routing through it.
 	// Examples:
 	//   Road("golang.org")
 	//   Road("192.0.2.1")
 	Road(ctx *Context, host string) Road
 }
 
+// Pac generates a proxy auto-config script from the router. Hosts on the locale road go direct, and all the others go
+// to the proxy, which blocks those on the fucked road by itself.
+func Pac(router Router, proxy string) string {
+	b := &strings.Builder{}
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\tvar ip = null;\n")
+	// Aimbot sends hosts on the puzzle road to the proxy.
+	if !PacRouter(b, router, proxy) {
+		fmt.Fprintf(b, "\treturn %q;\n", proxy)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// PacRouter writes the script of a router, and reports whether the script always returns. Routers unknown to pac are
+// skipped, as if they always return RoadPuzzle.
+func PacRouter(b *strings.Builder, router Router, proxy string) bool {
+	ret := func(road Road) string {
+		if road == RoadLocale {
+			return "DIRECT"
+		}
+		return proxy
+	}
+	switch r := router.(type) {
+	case *RouterCache:
+		return PacRouter(b, r.Raw, proxy)
+	case *RouterChain:
+		for _, e := range r.L {
+			if PacRouter(b, e, proxy) {
+				return true
+			}
+		}
+	case *RouterRules:
+		r.Mutex.RLock()
+		defer r.Mutex.RUnlock()
+		for _, e := range []struct {
+			road Road
+			list []string
+		}{{RoadLocale, r.L}, {RoadRemote, r.R}, {RoadFucked, r.B}} {
+			for _, glob := range e.list {
+				fmt.Fprintf(b, "\tif (shExpMatch(host, %q)) return %q;\n", glob, ret(e.road))
+			}
+		}
+	case *RouterIPNet:
+		r.Mutex.RLock()
+		defer r.Mutex.RUnlock()
+		// Pac has no way to match ipv6 addresses, those ipnets are skipped.
+		if r.Literal {
+			// Names are not resolved in literal mode. Local names go direct, and the others are left to the next routers.
+			local := `isPlainHostName(host) || dnsDomainIs(host, ".local") || dnsDomainIs(host, ".localhost")`
+			fmt.Fprintf(b, "\tif (%s) return %q;\n", local, ret(RoadLocale))
+			b.WriteString("\tip = /^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host) ? host : null;\n")
+		} else {
+			b.WriteString("\tip = ip || dnsResolve(host);\n")
+		}
+		b.WriteString("\tif (ip) {\n")
+		for _, e := range []struct {
+			road Road
+			list []*net.IPNet
+		}{{RoadLocale, r.L}, {RoadRemote, r.R}, {RoadFucked, r.B}} {
+			for _, cidr := range e.list {
+				if cidr.IP.To4() == nil || len(cidr.Mask) != net.IPv4len {
+					continue
+				}
+				addr := cidr.IP.String()
+				mask := net.IP(cidr.Mask).String()
+				fmt.Fprintf(b, "\t\tif (isInNet(ip, %q, %q)) return %q;\n", addr, mask, ret(e.road))
+			}
+		}
+		b.WriteString("\t}\n")
+	case *RouterRight:
+		if r.R != RoadPuzzle {
+			fmt.Fprintf(b, "\treturn %q;\n", ret(r.R))
+			return true
+		}
+	}
+	return false
+}
+
 // RouterIPNet is a router by IPNets. It judges whether an IP or domain name is within its range.
 type RouterIPNet struct {
 	L []*net.IPNet
 	R []*net.IPNet
 	B []*net.IPNet
+	// Policy decides how a host resolved to multiple addresses is routed.
+	Policy Policy
+	// Literal leaves domain names to the routers behind, and only routes literal ips. No dns query is sent by the
+	// local resolver then. Local names, which are localhost, names without a dot and names under .local, still go to
+	// the locale road, since they never resolve on the remote side.
+	Literal bool
+	// M holds the tables compiled from L, R and B. They are compiled on demand, and dropped once the lists change.
+	M atomic.Pointer[RouterIPNetMatcher]
+	// Mutex guards L, R and B once the router is in use.
+	Mutex sync.RWMutex
+}
+
+// RouterIPNetMatcher is the compiled form of the ipnets of a RouterIPNet.
+type RouterIPNetMatcher struct {
+	L *IPNets
+	R *IPNets
+	B *IPNets
 }
 
 // FromFile loads a CIDR file.
 func (r *RouterIPNet) FromFile(name string) {
-	f := doa.Try(OpenFile(name))
+	n := doa.Try(ReadRouterIPNet(name))
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	r.L = append(r.L, n.L...)
+	r.R = append(r.R, n.R...)
+	r.B = append(r.B, n.B...)
+	r.M.Store(nil)
+}
+
+// Reload replaces the ipnets loaded from files with the ones in a CIDR file, reserved ipnets are kept. Nothing changes
+// if the file fails to load.
+func (r *RouterIPNet) Reload(name string) error {
+	n, err := ReadRouterIPNet(name)
+	if err != nil {
+		return err
+	}
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	r.L = append(LoadReservedIP(), n.L...)
+	r.R = n.R
+	r.B = n.B
+	r.M.Store(nil)
+	return nil
+}
+
+// ReadRouterIPNet reads a CIDR file into a new RouterIPNet, which holds no reserved ipnets.
+func ReadRouterIPNet(name string) (*RouterIPNet, error) {
+	f, err := OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
 	defer f.Close()
+	r := &RouterIPNet{}
 	s := bufio.NewScanner(f)
 	for s.Scan() {
 		line := s.Text()
@@ -736,7 +2643,9 @@ func (r *RouterIPNet) FromFile(name string) {
 			continue
 		}
 		_, cidr, err := net.ParseCIDR(seps[1])
-		doa.Nil(err)
+		if err != nil {
+			return nil, err
+		}
 		switch seps[0] {
 		case "#":
 		case "L":
@@ -747,11 +2656,18 @@ func (r *RouterIPNet) FromFile(name string) {
 			r.B = append(r.B, cidr)
 		}
 	}
-	doa.Nil(s.Err())
+	return r, s.Err()
 }
 
 // Road implements daze.Router.
 func (r *RouterIPNet) Road(ctx *Context, host string) Road {
+	if r.Literal && net.ParseIP(host) == nil {
+		name := strings.ToLower(strings.TrimSuffix(host, "."))
+		if !strings.Contains(name, ".") || strings.HasSuffix(name, ".local") || strings.HasSuffix(name, ".localhost") {
+			return RoadLocale
+		}
+		return RoadPuzzle
+	}
 	l, err := func() ([]net.IPAddr, error) {
 		Expv.RouterIPNetCall.Add(1)
 		t := time.Now()
@@ -761,25 +2677,185 @@ func (r *RouterIPNet) Road(ctx *Context, host string) Road {
 	}()
 	if err != nil {
 		log.Printf("conn: %08x  error %s", ctx.Cid, err)
+		ctx.Rer = err
 		return RoadPuzzle
 	}
-	a := l[0]
-	for _, e := range r.L {
-		if e.Contains(a.IP) {
-			return RoadLocale
+	a, c := r.Pick(l)
+	ctx.Rip, _ = netip.AddrFromSlice(a.IP)
+	ctx.Rip = ctx.Rip.Unmap()
+	return c
+}
+
+// Pick chooses, according to the policy, the address a resolved host is routed by and returns it with its road.
+func (r *RouterIPNet) Pick(l []net.IPAddr) (net.IPAddr, Road) {
+	m := r.M.Load()
+	if m == nil {
+		r.Mutex.RLock()
+		m = &RouterIPNetMatcher{
+			L: NewIPNets(r.L),
+			R: NewIPNets(r.R),
+			B: NewIPNets(r.B),
 		}
+		r.M.Store(m)
+		r.Mutex.RUnlock()
 	}
-	for _, e := range r.R {
-		if e.Contains(a.IP) {
+	road := func(ip net.IP) Road {
+		switch {
+		case m.L.Contains(ip):
+			return RoadLocale
+		case m.R.Contains(ip):
 			return RoadRemote
+		case m.B.Contains(ip):
+			return RoadFucked
 		}
+		return RoadPuzzle
 	}
-	for _, e := range r.B {
-		if e.Contains(a.IP) {
-			return RoadFucked
+	if r.Policy == PolicyPrefer4 || r.Policy == PolicyPrefer6 {
+		slices.SortStableFunc(l, func(a, b net.IPAddr) int {
+			x, y := a.IP.To4() != nil, b.IP.To4() != nil
+			if x == y {
+				return 0
+			}
+			if x == (r.Policy == PolicyPrefer4) {
+				return -1
+			}
+			return +1
+		})
+	}
+	a, c := l[0], road(l[0].IP)
+	switch r.Policy {
+	case PolicyAnyLocal:
+		for _, e := range l {
+			if road(e.IP) == RoadLocale {
+				a, c = e, RoadLocale
+				break
+			}
+		}
+	case PolicyAllLocal:
+		for _, e := range l {
+			if d := road(e.IP); d != RoadLocale {
+				a, c = e, d
+				break
+			}
 		}
 	}
-	return RoadPuzzle
+	return a, c
+}
+
+// A Policy decides how a host resolved to multiple addresses is routed by RouterIPNet.
+type Policy uint32
+
+const (
+	// PolicyFirst routes the host by its first address, in the order of the resolver.
+	PolicyFirst Policy = iota
+	// PolicyAnyLocal routes the host to the locale road if any of its addresses is, else by the first address.
+	PolicyAnyLocal
+	// PolicyAllLocal routes the host to the locale road only if all its addresses are, else by the first address
+	// which is not.
+	PolicyAllLocal
+	// PolicyPrefer4 routes the host by its first ipv4 address, or by its first address if it has no ipv4 address.
+	PolicyPrefer4
+	// PolicyPrefer6 routes the host by its first ipv6 address, or by its first address if it has no ipv6 address.
+	PolicyPrefer6
+)
+
+func (p Policy) String() string {
+	switch p {
+	case PolicyFirst:
+		return "first"
+	case PolicyAnyLocal:
+		return "any-local"
+	case PolicyAllLocal:
+		return "all-local"
+	case PolicyPrefer4:
+		return "prefer-ipv4"
+	case PolicyPrefer6:
+		return "prefer-ipv6"
+	}
+	panic("unreachable")
+}
+
+// ParsePolicy parses a policy from its name.
+func ParsePolicy(name string) (Policy, error) {
+	for p := PolicyFirst; p <= PolicyPrefer6; p++ {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return PolicyFirst, fmt.Errorf("daze: unknown policy %s", name)
+}
+
+// IPNets is a compiled list of ipnets, it contains what any of the ipnets contains. The ipnets are merged into sorted
+// disjoint ranges, so an ip is looked up by a binary search rather than a linear scan. Ipv4 and ipv6 ipnets never
+// contain addresses of the other family, just like net.IPNet.
+type IPNets struct {
+	// L and R are the first and the last address of each range.
+	L []netip.Addr
+	R []netip.Addr
+}
+
+// Contains reports whether any of the ipnets contains the ip.
+func (n *IPNets) Contains(ip net.IP) bool {
+	a, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	a = a.Unmap()
+	i, _ := slices.BinarySearchFunc(n.R, a, netip.Addr.Compare)
+	return i < len(n.R) && n.L[i].Compare(a) <= 0
+}
+
+// NewIPNets returns a new IPNets.
+func NewIPNets(list []*net.IPNet) *IPNets {
+	r := make([]netip.Prefix, 0, len(list))
+	for _, e := range list {
+		mask := e.Mask
+		addr, ok := netip.AddrFromSlice(e.IP)
+		if !ok {
+			continue
+		}
+		if ip := e.IP.To4(); ip != nil {
+			addr = netip.AddrFrom4([4]byte(ip))
+			if len(mask) == net.IPv6len {
+				mask = mask[12:]
+			}
+		}
+		ones, bits := mask.Size()
+		if bits != addr.BitLen() {
+			continue
+		}
+		r = append(r, netip.PrefixFrom(addr, ones).Masked())
+	}
+	slices.SortFunc(r, func(a, b netip.Prefix) int {
+		return a.Addr().Compare(b.Addr())
+	})
+	n := &IPNets{L: []netip.Addr{}, R: []netip.Addr{}}
+	for _, e := range r {
+		// The last address of the ipnet is its first address with all host bits set.
+		b := e.Addr().AsSlice()
+		for i := e.Bits(); i < len(b)*8; i++ {
+			b[i/8] |= 0x80 >> (i % 8)
+		}
+		l := e.Addr()
+		h, _ := netip.AddrFromSlice(b)
+		// The ipnet is merged into the last range if they overlap or are adjacent. The next of the largest address of
+		// a family is invalid, then the last range already covers everything left of the family.
+		if k := len(n.R) - 1; k >= 0 && l.BitLen() == n.R[k].BitLen() {
+			next := n.R[k].Next()
+			if !next.IsValid() {
+				continue
+			}
+			if l.Compare(next) <= 0 {
+				if h.Compare(n.R[k]) > 0 {
+					n.R[k] = h
+				}
+				continue
+			}
+		}
+		n.L = append(n.L, l)
+		n.R = append(n.R, h)
+	}
+	return n
 }
 
 // NewRouterIPNet returns a new RouterIPNet object.
@@ -806,31 +2882,79 @@ func NewRouterRight(road Road) *RouterRight {
 	return &RouterRight{R: road}
 }
 
-// RouterCache cache routing results for next use.
+// RouterCache cache routing results for next use. Results expire after Conf.RouterPassTTL, or Conf.RouterFailTTL if
+// an error is met in routing. The ip evaluated for a road is cached along with it, so that a host is dialed to the same
+// ip that decided its road for as long as the road is kept.
 type RouterCache struct {
-	Lru *lru.Lru[string, Road]
+	Lru *lru.Lru[string, RouterCacheItem]
 	Raw Router
 }
 
+// RouterCacheItem is a cached routing result.
+type RouterCacheItem struct {
+	Road Road
+	Rip  netip.Addr
+}
+
 // Road implements daze.Router.
 func (r *RouterCache) Road(ctx *Context, host string) Road {
 	Expv.RouterCacheCall.Add(1)
+	ctx.Rip = netip.Addr{}
+	ctx.Rer = nil
 	a, b := r.Lru.GetExists(host)
 	if b {
 		Expv.RouterCacheHits.Add(1)
-		return a
+		ctx.Rip = a.Rip
+		return a.Road
 	}
 	c := r.Raw.Road(ctx, host)
-	r.Lru.Set(host, c)
+	if c == RoadPuzzle || ctx.Rer != nil {
+		r.Lru.SetExpire(host, RouterCacheItem{Road: c, Rip: ctx.Rip}, Conf.RouterFailTTL)
+	} else {
+		r.Lru.SetExpire(host, RouterCacheItem{Road: c, Rip: ctx.Rip}, Conf.RouterPassTTL)
+	}
 	return c
 }
 
 // NewRouterCache returns a new Cache object.
 func NewRouterCache(r Router) *RouterCache {
-	return &RouterCache{
-		Lru: lru.New[string, Road](Conf.RouterLruSize),
+	c := &RouterCache{
+		Lru: lru.New[string, RouterCacheItem](Conf.RouterLruSize),
 		Raw: r,
 	}
+	c.Lru.Expire = func(k string, v RouterCacheItem) {
+		Expv.RouterCacheExpi.Add(1)
+	}
+	return c
+}
+
+// Flush removes all cached results. It should be called once the rules of the raw router are reloaded.
+func (r *RouterCache) Flush() {
+	Expv.RouterCacheWipe.Add(1)
+	r.Lru.Clear()
+}
+
+// RouterReload reloads the rule and cidr files of the option into a router and the routers it wraps, and flushes
+// their caches. Routers that are not loaded from files are left untouched.
+func RouterReload(router Router, option *AimbotOption) error {
+	switch r := router.(type) {
+	case *RouterCache:
+		defer r.Flush()
+		return RouterReload(r.Raw, option)
+	case *RouterChain:
+		for _, e := range r.L {
+			if err := RouterReload(e, option); err != nil {
+				return err
+			}
+		}
+	case *RouterRules:
+		return r.Reload(option.Rule)
+	case *RouterIPNet:
+		if option.Type == "rule" {
+			return r.Reload(option.Cidr)
+		}
+	}
+	return nil
 }
 
 // RouterChain concat multiple routers in series.
@@ -880,32 +3004,78 @@ type RouterRules struct {
 	L []string
 	R []string
 	B []string
+	// M holds the matchers compiled from L, R and B. They are compiled on demand, and dropped once the lists change.
+	M atomic.Pointer[RouterRulesMatcher]
+	// Mutex guards L, R and B once the router is in use.
+	Mutex sync.RWMutex
+}
+
+// RouterRulesMatcher is the compiled form of the globs of a RouterRules.
+type RouterRulesMatcher struct {
+	L *Globs
+	R *Globs
+	B *Globs
 }
 
 // Road implements daze.Router.
 func (r *RouterRules) Road(ctx *Context, host string) Road {
-	for _, e := range r.L {
-		if doa.Try(filepath.Match(e, host)) {
-			return RoadLocale
+	m := r.M.Load()
+	if m == nil {
+		r.Mutex.RLock()
+		m = &RouterRulesMatcher{
+			L: NewGlobs(r.L),
+			R: NewGlobs(r.R),
+			B: NewGlobs(r.B),
 		}
+		r.M.Store(m)
+		r.Mutex.RUnlock()
 	}
-	for _, e := range r.R {
-		if doa.Try(filepath.Match(e, host)) {
-			return RoadRemote
-		}
+	if m.L.Match(host) {
+		return RoadLocale
 	}
-	for _, e := range r.B {
-		if doa.Try(filepath.Match(e, host)) {
-			return RoadFucked
-		}
+	if m.R.Match(host) {
+		return RoadRemote
+	}
+	if m.B.Match(host) {
+		return RoadFucked
 	}
 	return RoadPuzzle
 }
 
 // FromFile loads a RULE file.
 func (r *RouterRules) FromFile(name string) {
-	f := doa.Try(OpenFile(name))
+	n := doa.Try(ReadRouterRules(name))
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	r.L = append(r.L, n.L...)
+	r.R = append(r.R, n.R...)
+	r.B = append(r.B, n.B...)
+	r.M.Store(nil)
+}
+
+// Reload replaces the rules with the ones in a RULE file. Nothing changes if the file fails to load.
+func (r *RouterRules) Reload(name string) error {
+	n, err := ReadRouterRules(name)
+	if err != nil {
+		return err
+	}
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	r.L = n.L
+	r.R = n.R
+	r.B = n.B
+	r.M.Store(nil)
+	return nil
+}
+
+// ReadRouterRules reads a RULE file into a new RouterRules.
+func ReadRouterRules(name string) (*RouterRules, error) {
+	f, err := OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
 	defer f.Close()
+	r := NewRouterRules()
 	s := bufio.NewScanner(f)
 	for s.Scan() {
 		line := s.Text()
@@ -923,7 +3093,7 @@ func (r *RouterRules) FromFile(name string) {
 			r.B = append(r.B, seps[1:]...)
 		}
 	}
-	doa.Nil(s.Err())
+	return r, s.Err()
 }
 
 // NewRouterRules returns a new RoaderRules.
@@ -935,31 +3105,139 @@ func NewRouterRules() *RouterRules {
 	}
 }
 
+// Globs is a compiled list of glob patterns, it matches what any of the patterns matches. Plain names and names led by
+// "*." are stored in a suffix trie of reversed labels, so they are matched in time proportional to the number of
+// labels of the host rather than the number of patterns. Other patterns fall back to a linear scan.
+type Globs struct {
+	Rest []string
+	Trie *GlobsNode
+}
+
+// GlobsNode is a label of the suffix trie.
+type GlobsNode struct {
+	// Full reports whether a plain name ends at the label.
+	Full bool
+	Next map[string]*GlobsNode
+	// Star reports whether a name led by "*." ends at the label.
+	Star bool
+}
+
+// Match reports whether the host matches any of the patterns.
+func (g *Globs) Match(host string) bool {
+	n := g.Trie
+	s := host
+	for {
+		i := strings.LastIndexByte(s, '.')
+		n = n.Next[s[i+1:]]
+		if n == nil {
+			break
+		}
+		// The star matches any string, including the empty string and dots.
+		if i < 0 {
+			if n.Full {
+				return true
+			}
+			break
+		}
+		if n.Star {
+			return true
+		}
+		s = s[:i]
+	}
+	for _, e := range g.Rest {
+		if doa.Try(filepath.Match(e, host)) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewGlobs returns a new Globs.
+func NewGlobs(list []string) *Globs {
+	g := &Globs{
+		Rest: []string{},
+		Trie: &GlobsNode{Next: map[string]*GlobsNode{}},
+	}
+	for _, e := range list {
+		name, star := strings.CutPrefix(e, "*.")
+		if name == "" || strings.ContainsAny(name, "*?[\\") {
+			g.Rest = append(g.Rest, e)
+			continue
+		}
+		n := g.Trie
+		for {
+			i := strings.LastIndexByte(name, '.')
+			if n.Next[name[i+1:]] == nil {
+				n.Next[name[i+1:]] = &GlobsNode{Next: map[string]*GlobsNode{}}
+			}
+			n = n.Next[name[i+1:]]
+			if i < 0 {
+				break
+			}
+			name = name[:i]
+		}
+		if star {
+			n.Star = true
+		} else {
+			n.Full = true
+		}
+	}
+	return g
+}
+
 // Aimbot automatically distinguish whether to use a proxy or a local network.
 type Aimbot struct {
+	Fakeip *Fakeip
 	Remote Dialer
 	Locale Dialer
 	Router Router
 }
 
+// Reveal restores the name of the address if its host is a fake ip, so that the name is routed and resolved instead.
+func (s *Aimbot) Reveal(ctx *Context, address string) (string, error) {
+	if s.Fakeip == nil {
+		return address, nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil || !s.Fakeip.Contains(ip) {
+		return address, nil
+	}
+	name, ok := s.Fakeip.Lookup(ip)
+	if !ok {
+		return "", fmt.Errorf("daze: fake ip %s has expired", ip)
+	}
+	log.Printf("conn: %08x  fakeip name=%s", ctx.Cid, name)
+	return net.JoinHostPort(name, port), nil
+}
+
 // Dial connects to the address on the named network.
 func (s *Aimbot) Dial(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
 	var (
-		dst string
-		err error
-		rwc io.ReadWriteCloser
-		tag Road
+		dst  string
+		err  error
+		port string
+		rwc  io.ReadWriteCloser
+		tag  Road
 	)
 	log.Printf("conn: %08x   dial network=%s address=%s", ctx.Cid, network, address)
-	dst, _, err = net.SplitHostPort(address)
+	address, err = s.Reveal(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	dst, port, err = net.SplitHostPort(address)
 	if err != nil {
 		return nil, err
 	}
+	ctx.Rip = netip.Addr{}
 	tag = s.Router.Road(ctx, dst)
 	log.Printf("conn: %08x  route road=%s", ctx.Cid, tag)
 	switch tag {
 	case RoadLocale:
-		rwc, err = s.Locale.Dial(ctx, network, address)
+		rwc, err = s.Locale.Dial(ctx, network, s.Target(ctx, address, port))
 	case RoadRemote:
 		rwc, err = s.Remote.Dial(ctx, network, address)
 	case RoadFucked:
@@ -973,11 +3251,71 @@ func (s *Aimbot) Dial(ctx *Context, network string, address string) (io.ReadWrit
 	return rwc, err
 }
 
+// Target returns the address to connect to on the locale road. It is the ip evaluated by the router if there is one,
+// so the connection goes to the very ip that decided the road.
+func (s *Aimbot) Target(ctx *Context, address string, port string) string {
+	if !ctx.Rip.IsValid() {
+		return address
+	}
+	log.Printf("conn: %08x  route addr=%s", ctx.Cid, ctx.Rip)
+	return net.JoinHostPort(ctx.Rip.String(), port)
+}
+
+// Bind waits for an inbound connection from the address on the named network. The listener is created on the side
+// that the router selects for the address.
+func (s *Aimbot) Bind(ctx *Context, network string, address string) (Bound, error) {
+	var (
+		bnd  Bound
+		dst  string
+		err  error
+		dia  Dialer
+		port string
+		tag  Road
+	)
+	log.Printf("conn: %08x   bind network=%s address=%s", ctx.Cid, network, address)
+	address, err = s.Reveal(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	dst, port, err = net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Rip = netip.Addr{}
+	tag = s.Router.Road(ctx, dst)
+	log.Printf("conn: %08x  route road=%s", ctx.Cid, tag)
+	switch tag {
+	case RoadLocale:
+		dia = s.Locale
+		address = s.Target(ctx, address, port)
+	case RoadRemote:
+		dia = s.Remote
+	case RoadFucked:
+		return nil, fmt.Errorf("conn: %s has been blocked", dst)
+	case RoadPuzzle:
+		dia = s.Remote
+	}
+	binder, ok := dia.(Binder)
+	if !ok {
+		return nil, errors.New("daze: bind is not supported")
+	}
+	bnd, err = binder.Bind(ctx, network, address)
+	if err == nil {
+		log.Printf("conn: %08x  bound address=%s", ctx.Cid, bnd.Addr())
+	}
+	return bnd, err
+}
+
 // AimbotOption provides configuration for quick initialization of Aimbot.
 type AimbotOption struct {
 	Type string
 	Rule string
 	Cidr string
+	// Policy decides how a host resolved to multiple addresses is routed by cidr.
+	Policy Policy
+	// Literal routes only literal ips by cidr. Domain names not matched by rule go to the remote road, so that they are
+	// never resolved by the local dns.
+	Literal bool
 }
 
 // NewAimbot returns a new Aimbot.
@@ -989,6 +3327,8 @@ func NewAimbot(client Dialer, option *AimbotOption) *Aimbot {
 		}
 		if option.Type == "remote" {
 			routerLocal := NewRouterIPNet()
+			routerLocal.Policy = option.Policy
+			routerLocal.Literal = option.Literal
 			routerRight := NewRouterRight(RoadRemote)
 			routerChain := NewRouterChain(routerLocal, routerRight)
 			routerCache := NewRouterCache(routerChain)
@@ -1003,6 +3343,8 @@ func NewAimbot(client Dialer, option *AimbotOption) *Aimbot {
 			log.Println("main: load rule", option.Cidr)
 			routerLocal := NewRouterIPNet()
 			routerLocal.FromFile(option.Cidr)
+			routerLocal.Policy = option.Policy
+			routerLocal.Literal = option.Literal
 			log.Println("main: size is", len(routerLocal.L)+len(routerLocal.R)+len(routerLocal.B))
 
 			routerRight := NewRouterRight(RoadRemote)
@@ -1035,6 +3377,9 @@ func NewAimbot(client Dialer, option *AimbotOption) *Aimbot {
 
 // Check interface implementation.
 var (
+	_ Binder = (*Aimbot)(nil)
+	_ Binder = (*Direct)(nil)
+	_ Bound  = (*DirectBound)(nil)
 	_ Dialer = (*Aimbot)(nil)
 	_ Dialer = (*Direct)(nil)
 	_ Router = (*RouterCache)(nil)
@@ -1052,6 +3397,29 @@ func Dial(network string, address string) (net.Conn, error) {
 	return d.Dial(network, address)
 }
 
+// Listen announces on the local address that would be used to reach the address on the named network, so the peer at
+// that address is able to connect back to the listener. Only tcp is supported.
+func Listen(network string, address string) (net.Listener, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("daze: network must be tcp")
+	}
+	dst, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	host := ""
+	// Dialing udp sends nothing, it just asks the kernel to choose the outbound interface.
+	if c, err := net.Dial("udp", address); err == nil {
+		ip := c.LocalAddr().(*net.UDPAddr).IP
+		c.Close()
+		// An unspecified address is routed through the loopback interface, listen on all interfaces instead.
+		if !ip.IsLoopback() || net.ParseIP(dst).IsLoopback() {
+			host = ip.String()
+		}
+	}
+	return net.Listen("tcp", net.JoinHostPort(host, "0"))
+}
+
 // GravityReader wraps an io.Reader with RC4 crypto.
 func GravityReader(r io.Reader, k []byte) io.Reader {
 	cr := doa.Try(rc4.NewCipher(k))
@@ -1308,6 +3676,7 @@ func (t *Tester) TCP() error {
 
 // TCPServe serves incoming connections.
 func (t *Tester) TCPServe(cli io.ReadWriteCloser) {
+	defer cli.Close()
 	buf := make([]byte, 2048)
 	for {
 		_, err := io.ReadFull(cli, buf[:4])
@@ -0,0 +1,275 @@
+//go:build linux
+
+package daze
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// Netfilter socket options. See linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h.
+const (
+	SoOriginalDst     = 80
+	Ip6tSoOriginalDst = 80
+)
+
+// Ipv6 socket options missing in syscall. See linux/in6.h.
+const (
+	Ipv6RecvOrigDstAddr = 74
+	Ipv6Transparent     = 75
+)
+
+// OriginalDst returns the destination of a tcp connection before it was redirected by iptables or nftables.
+func OriginalDst(c *net.TCPConn) (string, error) {
+	var (
+		dst string
+		err error
+		raw syscall.RawConn
+	)
+	raw, err = c.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	ipv4 := c.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	ctl := raw.Control(func(fd uintptr) {
+		var (
+			buf = make([]byte, 2)
+			ip  net.IP
+		)
+		if ipv4 {
+			// There is no getsockopt for struct sockaddr_in in syscall, but struct ipv6_mreq is large enough to hold it.
+			mrq, e := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, SoOriginalDst)
+			if e != nil {
+				err = e
+				return
+			}
+			ip = net.IP(mrq.Multiaddr[4:8])
+			copy(buf, mrq.Multiaddr[2:4])
+		} else {
+			// Likewise, struct ip6_mtuinfo starts with a struct sockaddr_in6.
+			mtu, e := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, Ip6tSoOriginalDst)
+			if e != nil {
+				err = e
+				return
+			}
+			ip = net.IP(mtu.Addr.Addr[:])
+			binary.NativeEndian.PutUint16(buf, mtu.Addr.Port)
+		}
+		dst = net.JoinHostPort(ip.String(), strconv.Itoa(int(binary.BigEndian.Uint16(buf))))
+	})
+	if ctl != nil {
+		return "", ctl
+	}
+	return dst, err
+}
+
+// TproxyControl sets the options required by a tproxy socket: it may bind to a non-local address, and reports the
+// original destination of received datagrams.
+func TproxyControl(network string, address string, c syscall.RawConn) error {
+	var err error
+	ctl := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		if err != nil {
+			return
+		}
+		if network == "udp6" {
+			err = errors.Join(
+				syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, Ipv6Transparent, 1),
+				syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, Ipv6RecvOrigDstAddr, 1),
+			)
+			if err != nil {
+				return
+			}
+			// A dual-stack socket also receives ipv4 datagrams, but it is fine to go without them.
+			syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
+			return
+		}
+		err = errors.Join(
+			syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1),
+			syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1),
+		)
+	})
+	if ctl != nil {
+		return ctl
+	}
+	return err
+}
+
+// ListenTproxy announces on the local address for udp datagrams diverted by the TPROXY target of iptables.
+func ListenTproxy(address string) (*net.UDPConn, error) {
+	l := net.ListenConfig{Control: TproxyControl}
+	c, err := l.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
+
+// ReadFromTproxy reads a datagram from a tproxy socket, returns its source and original destination address.
+func ReadFromTproxy(c *net.UDPConn, b []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	oob := make([]byte, 128)
+	n, oobn, _, src, err := c.ReadMsgUDP(b, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	msg, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	for _, e := range msg {
+		switch {
+		case e.Header.Level == syscall.SOL_IP && e.Header.Type == syscall.IP_ORIGDSTADDR && len(e.Data) >= 8:
+			// Data is a struct sockaddr_in.
+			dst := &net.UDPAddr{
+				IP:   net.IP(e.Data[4:8]),
+				Port: int(binary.BigEndian.Uint16(e.Data[2:4])),
+			}
+			return n, src, dst, nil
+		case e.Header.Level == syscall.SOL_IPV6 && e.Header.Type == Ipv6RecvOrigDstAddr && len(e.Data) >= 24:
+			// Data is a struct sockaddr_in6.
+			dst := &net.UDPAddr{
+				IP:   net.IP(e.Data[8:24]),
+				Port: int(binary.BigEndian.Uint16(e.Data[2:4])),
+			}
+			return n, src, dst, nil
+		}
+	}
+	return 0, nil, nil, errors.New("daze: original destination not found")
+}
+
+// DialTproxy returns a udp socket bound to the non-local address laddr and connected to raddr. It is used to send
+// replies with the original destination as their source address.
+func DialTproxy(laddr *net.UDPAddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	d := net.Dialer{LocalAddr: laddr, Control: TproxyControl}
+	c, err := d.Dial("udp", raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
+
+// TunStack is a userspace network stack running on a tun device.
+type TunStack struct {
+	fd int
+	s  *stack.Stack
+}
+
+// Close closes the network stack and the tun device.
+func (t *TunStack) Close() error {
+	t.s.Destroy()
+	return syscall.Close(t.fd)
+}
+
+// ListenTun opens the tun device and serves its flows by the tun.
+func ListenTun(t *Tun) (io.Closer, error) {
+	i, err := net.InterfaceByName(t.Listen)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := tun.Open(t.Listen)
+	if err != nil {
+		return nil, err
+	}
+	ep, err := fdbased.New(&fdbased.Options{FDs: []int{fd}, MTU: uint32(i.MTU)})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	s, err := ServeTunStack(t, ep)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &TunStack{fd: fd, s: s}, nil
+}
+
+// ServeTunStack creates a userspace network stack on the link endpoint, and serves the flows passing through it by the
+// tun.
+func ServeTunStack(t *Tun, ep stack.LinkEndpoint) (*stack.Stack, error) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	if err := s.CreateNIC(1, ep); err != nil {
+		s.Destroy()
+		return nil, errors.New(err.String())
+	}
+	// Accept packets of any destination, and reply with any source address. Together, every flow passing through the
+	// device is terminated here.
+	s.SetPromiscuousMode(1, true)
+	s.SetSpoofing(1, true)
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: 1},
+		{Destination: header.IPv6EmptySubnet, NIC: 1},
+	})
+
+	idx := atomic.Uint32{}
+	tcpForwarder := tcp.NewForwarder(s, 0, 1024, func(r *tcp.ForwarderRequest) {
+		id := r.ID()
+		ctx := &Context{Cid: idx.Add(1) - 1}
+		src := net.JoinHostPort(id.RemoteAddress.String(), strconv.Itoa(int(id.RemotePort)))
+		log.Printf("conn: %08x accept remote=%s", ctx.Cid, src)
+		wq := &waiter.Queue{}
+		ep, err := r.CreateEndpoint(wq)
+		if err != nil {
+			r.Complete(true)
+			log.Printf("conn: %08x  error %s", ctx.Cid, err)
+			return
+		}
+		r.Complete(false)
+		cli := gonet.NewTCPConn(wq, ep)
+		dst := net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort)))
+		go func() {
+			defer cli.Close()
+			if err := t.ServeTCP(ctx, cli, dst); err != nil {
+				log.Printf("conn: %08x  error %s", ctx.Cid, err)
+			}
+			log.Printf("conn: %08x closed", ctx.Cid)
+		}()
+	})
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+	udpForwarder := udp.NewForwarder(s, func(r *udp.ForwarderRequest) bool {
+		id := r.ID()
+		ctx := &Context{Cid: idx.Add(1) - 1}
+		src := net.JoinHostPort(id.RemoteAddress.String(), strconv.Itoa(int(id.RemotePort)))
+		log.Printf("conn: %08x accept remote=%s", ctx.Cid, src)
+		wq := &waiter.Queue{}
+		ep, err := r.CreateEndpoint(wq)
+		if err != nil {
+			log.Printf("conn: %08x  error %s", ctx.Cid, err)
+			return true
+		}
+		cli := gonet.NewUDPConn(wq, ep)
+		dst := net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort)))
+		go func() {
+			defer cli.Close()
+			if err := t.ServeUDP(ctx, cli, dst); err != nil {
+				log.Printf("conn: %08x  error %s", ctx.Cid, err)
+			}
+			log.Printf("conn: %08x closed", ctx.Cid)
+		}()
+		return true
+	})
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+	return s, nil
+}
@@ -0,0 +1,78 @@
+//go:build linux
+
+package daze
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/libraries/daze/lib/doa"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/pipe"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// tunDialer records the destinations of the tun, and dials its own address instead.
+type tunDialer struct {
+	Addr map[string]string
+	Dest chan string
+}
+
+func (d *tunDialer) Dial(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
+	d.Dest <- network + "://" + address
+	return net.Dial(network, d.Addr[network])
+}
+
+func TestTunStack(t *testing.T) {
+	tcpTester := NewTester(DazeTesterListenOn)
+	defer tcpTester.Close()
+	tcpTester.TCP()
+	udpTester := NewTester(DazeTesterListenOn)
+	defer udpTester.Close()
+	udpTester.UDP()
+
+	dialer := &tunDialer{
+		Addr: map[string]string{"tcp": DazeTesterListenOn, "udp": DazeTesterListenOn},
+		Dest: make(chan string, 2),
+	}
+	a, b := pipe.New("", "", 1500)
+	srv := doa.Try(ServeTunStack(NewTun("", dialer), b))
+	defer srv.Destroy()
+
+	// The app side is a plain stack, which routes everything to the tun.
+	cli := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	defer cli.Destroy()
+	doa.Doa(cli.CreateNIC(1, a) == nil)
+	doa.Doa(cli.AddProtocolAddress(1, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4([4]byte{198, 18, 0, 1}).WithPrefix(),
+	}, stack.AddressProperties{}) == nil)
+	cli.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: 1}})
+	dst := tcpip.FullAddress{NIC: 1, Addr: tcpip.AddrFrom4([4]byte{203, 0, 113, 1}), Port: 80}
+
+	buf := make([]byte, 2048)
+	tcpConn := doa.Try(gonet.DialTCP(cli, dst, ipv4.ProtocolNumber))
+	defer tcpConn.Close()
+	doa.Doa(<-dialer.Dest == "tcp://203.0.113.1:80")
+	doa.Try(tcpConn.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+	tcpConn.SetReadDeadline(time.Now().Add(time.Second))
+	doa.Try(io.ReadFull(tcpConn, buf[:128]))
+
+	udpConn := doa.Try(gonet.DialUDP(cli, nil, &dst, ipv4.ProtocolNumber))
+	defer udpConn.Close()
+	doa.Try(udpConn.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+	doa.Doa(<-dialer.Dest == "udp://203.0.113.1:80")
+	udpConn.SetReadDeadline(time.Now().Add(time.Second))
+	n := doa.Try(udpConn.Read(buf))
+	doa.Doa(n == 128)
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+
+package daze
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// OriginalDst returns the destination of a tcp connection before it was redirected by iptables or nftables.
+func OriginalDst(c *net.TCPConn) (string, error) {
+	return "", errors.New("daze: transparent proxy is only supported on linux")
+}
+
+// ListenTproxy announces on the local address for udp datagrams diverted by the TPROXY target of iptables.
+func ListenTproxy(address string) (*net.UDPConn, error) {
+	return nil, errors.New("daze: transparent proxy is only supported on linux")
+}
+
+// ReadFromTproxy reads a datagram from a tproxy socket, returns its source and original destination address.
+func ReadFromTproxy(c *net.UDPConn, b []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	return 0, nil, nil, errors.New("daze: transparent proxy is only supported on linux")
+}
+
+// DialTproxy returns a udp socket bound to the non-local address laddr and connected to raddr. It is used to send
+// replies with the original destination as their source address.
+func DialTproxy(laddr *net.UDPAddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errors.New("daze: transparent proxy is only supported on linux")
+}
+
+// ListenTun opens the tun device and serves its flows by the tun.
+func ListenTun(t *Tun) (io.Closer, error) {
+	return nil, errors.New("daze: tun is only supported on linux")
+}
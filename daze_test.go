@@ -1,17 +1,40 @@
 package daze
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/libraries/daze/lib/doa"
+	"github.com/libraries/daze/lib/rate"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 const (
 	CurlDest           = "https://www.zhihu.com"
 	DazeLocaleListenOn = "127.0.0.1:28080"
+	DazeTesterListenOn = "127.0.0.1:28081"
 	HostLookup         = "google.com"
 )
 
@@ -55,6 +78,595 @@ func TestLocaleSocks5(t *testing.T) {
 	doa.Doa(bytes.Contains(out, []byte("zhihu")))
 }
 
+func TestLocaleSocks5Passwd(t *testing.T) {
+	dazeTester := NewTester(DazeTesterListenOn)
+	defer dazeTester.Close()
+	dazeTester.TCP()
+
+	locale := NewLocale(DazeLocaleListenOn, &Direct{})
+	locale.Passwd = NewPasswd("user:pass")
+	defer locale.Close()
+	locale.Run()
+
+	buf := make([]byte, 16)
+
+	cli := doa.Try(net.Dial("tcp", DazeLocaleListenOn))
+	doa.Try(cli.Write([]byte{0x05, 0x01, 0x00}))
+	doa.Try(io.ReadFull(cli, buf[:2]))
+	doa.Doa(bytes.Equal(buf[:2], []byte{0x05, 0xff}))
+	cli.Close()
+
+	cli = doa.Try(net.Dial("tcp", DazeLocaleListenOn))
+	doa.Try(cli.Write([]byte{0x05, 0x02, 0x00, 0x02}))
+	doa.Try(io.ReadFull(cli, buf[:2]))
+	doa.Doa(bytes.Equal(buf[:2], []byte{0x05, 0x02}))
+	doa.Try(cli.Write([]byte{0x01, 0x04, 'u', 's', 'e', 'r', 0x04, 'p', 'a', 's', 'e'}))
+	doa.Try(io.ReadFull(cli, buf[:2]))
+	doa.Doa(bytes.Equal(buf[:2], []byte{0x01, 0x01}))
+	cli.Close()
+
+	cli = doa.Try(net.Dial("tcp", DazeLocaleListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x05, 0x02, 0x00, 0x02}))
+	doa.Try(io.ReadFull(cli, buf[:2]))
+	doa.Doa(bytes.Equal(buf[:2], []byte{0x05, 0x02}))
+	doa.Try(cli.Write([]byte{0x01, 0x04, 'u', 's', 'e', 'r', 0x04, 'p', 'a', 's', 's'}))
+	doa.Try(io.ReadFull(cli, buf[:2]))
+	doa.Doa(bytes.Equal(buf[:2], []byte{0x01, 0x00}))
+	doa.Try(cli.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, 0x6d, 0xb1}))
+	doa.Try(io.ReadFull(cli, buf[:10]))
+	doa.Doa(buf[1] == 0x00)
+	doa.Try(cli.Write([]byte{0x00, 0x01, 0x00, 0x10}))
+	doa.Try(io.ReadFull(cli, buf[:16]))
+	doa.Doa(bytes.Equal(buf[:16], bytes.Repeat([]byte{0x01}, 16)))
+}
+
+func TestLocaleMulti(t *testing.T) {
+	dazeTester := NewTester(DazeTesterListenOn)
+	defer dazeTester.Close()
+	dazeTester.TCP()
+
+	path := filepath.Join(t.TempDir(), "daze.sock")
+	list := NewLocaleMulti(DazeLocaleListenOn+"?auth=false,unix:"+path+"?mode=0600", &Direct{}, NewPasswd("user:pass"))
+	doa.Doa(len(list) == 2)
+	for _, locale := range list {
+		defer locale.Close()
+		doa.Nil(locale.Run())
+	}
+	doa.Doa(doa.Try(os.Stat(path)).Mode().Perm() == 0600)
+
+	buf := make([]byte, 16)
+
+	cli := doa.Try(net.Dial("unix", path))
+	doa.Try(cli.Write([]byte{0x05, 0x01, 0x00}))
+	doa.Try(io.ReadFull(cli, buf[:2]))
+	doa.Doa(bytes.Equal(buf[:2], []byte{0x05, 0xff}))
+	cli.Close()
+
+	cli = doa.Try(net.Dial("tcp", DazeLocaleListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x05, 0x01, 0x00}))
+	doa.Try(io.ReadFull(cli, buf[:2]))
+	doa.Doa(bytes.Equal(buf[:2], []byte{0x05, 0x00}))
+	doa.Try(cli.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, 0x6d, 0xb1}))
+	doa.Try(io.ReadFull(cli, buf[:10]))
+	doa.Doa(buf[1] == 0x00)
+	doa.Try(cli.Write([]byte{0x00, 0x01, 0x00, 0x10}))
+	doa.Try(io.ReadFull(cli, buf[:16]))
+	doa.Doa(bytes.Equal(buf[:16], bytes.Repeat([]byte{0x01}, 16)))
+}
+
+func TestLocaleHttpPasswd(t *testing.T) {
+	dazeTester := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doa.Doa(r.Header.Get("Proxy-Authorization") == "")
+		w.Write([]byte("daze"))
+	}))
+	defer dazeTester.Close()
+
+	locale := NewLocale(DazeLocaleListenOn, &Direct{})
+	locale.Passwd = NewPasswd("user:pass")
+	defer locale.Close()
+	locale.Run()
+
+	for _, e := range []struct {
+		user *url.Userinfo
+		code int
+	}{
+		{nil, http.StatusProxyAuthRequired},
+		{url.UserPassword("user", "pase"), http.StatusProxyAuthRequired},
+		{url.UserPassword("user", "pass"), http.StatusOK},
+	} {
+		cli := &http.Client{Transport: &http.Transport{
+			Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: DazeLocaleListenOn, User: e.user}),
+		}}
+		rep := doa.Try(cli.Get(dazeTester.URL))
+		doa.Doa(rep.StatusCode == e.code)
+		rep.Body.Close()
+		cli.CloseIdleConnections()
+	}
+}
+
+func TestLocaleHttpKeepAlive(t *testing.T) {
+	conn := atomic.Int32{}
+	wait := make(chan struct{})
+	dazeTester := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doa.Doa(r.Header.Get("Proxy-Connection") == "")
+		switch r.URL.Path {
+		case "/echo":
+			io.Copy(w, r.Body)
+		case "/flow":
+			// The first chunk must reach the client before the response is finished.
+			w.Write([]byte("da"))
+			w.(http.Flusher).Flush()
+			<-wait
+			w.Write([]byte("ze"))
+		}
+	}))
+	dazeTester.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			conn.Add(1)
+		}
+	}
+	dazeTester.Start()
+	defer dazeTester.Close()
+
+	locale := NewLocale(DazeLocaleListenOn, &Direct{})
+	defer locale.Close()
+	locale.Run()
+
+	cli := doa.Try(net.Dial("tcp", DazeLocaleListenOn))
+	defer cli.Close()
+	rdr := bufio.NewReader(cli)
+	for _, body := range []string{"daze", "", "daze daze"} {
+		req := doa.Try(http.NewRequest("POST", dazeTester.URL+"/echo", strings.NewReader(body)))
+		req.Header.Set("Proxy-Connection", "keep-alive")
+		doa.Nil(req.WriteProxy(cli))
+		rep := doa.Try(http.ReadResponse(rdr, req))
+		doa.Doa(string(doa.Try(io.ReadAll(rep.Body))) == body)
+	}
+	req := doa.Try(http.NewRequest("GET", dazeTester.URL+"/flow", nil))
+	doa.Nil(req.WriteProxy(cli))
+	rep := doa.Try(http.ReadResponse(rdr, req))
+	doa.Doa(rep.TransferEncoding[0] == "chunked")
+	buf := make([]byte, 2)
+	doa.Try(io.ReadFull(rep.Body, buf))
+	doa.Doa(string(buf) == "da")
+	close(wait)
+	doa.Doa(string(doa.Try(io.ReadAll(rep.Body))) == "ze")
+	// All requests of the session share a single upstream connection.
+	doa.Doa(conn.Load() == 1)
+
+	req = doa.Try(http.NewRequest("GET", dazeTester.URL+"/echo", nil))
+	req.Close = true
+	doa.Nil(req.WriteProxy(cli))
+	rep = doa.Try(http.ReadResponse(rdr, req))
+	doa.Doa(rep.Close)
+	io.ReadAll(rep.Body)
+	_, err := rdr.ReadByte()
+	doa.Doa(err == io.EOF)
+}
+
+func TestLocaleHttpExpect(t *testing.T) {
+	dazeTester := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doa.Doa(r.Header.Get("Expect") == "")
+		io.Copy(w, r.Body)
+	}))
+	defer dazeTester.Close()
+
+	locale := NewLocale(DazeLocaleListenOn, &Direct{})
+	defer locale.Close()
+	locale.Run()
+
+	cli := doa.Try(net.Dial("tcp", DazeLocaleListenOn))
+	defer cli.Close()
+	cli.SetDeadline(time.Now().Add(time.Second * 4))
+	rdr := bufio.NewReader(cli)
+	// The body is held back until the client is told to continue.
+	head := "POST " + dazeTester.URL + "/echo HTTP/1.1\r\nHost: " + dazeTester.Listener.Addr().String() + "\r\n"
+	head += "Content-Length: 4\r\nExpect: 100-continue\r\n\r\n"
+	doa.Try(cli.Write([]byte(head)))
+	rep := doa.Try(http.ReadResponse(rdr, nil))
+	doa.Doa(rep.StatusCode == http.StatusContinue)
+	doa.Try(cli.Write([]byte("daze")))
+	rep = doa.Try(http.ReadResponse(rdr, nil))
+	doa.Doa(rep.StatusCode == http.StatusOK)
+	doa.Doa(string(doa.Try(io.ReadAll(rep.Body))) == "daze")
+}
+
+func TestLocaleTLS(t *testing.T) {
+	dazeTester := NewTester(DazeTesterListenOn)
+	defer dazeTester.Close()
+	dazeTester.TCP()
+	dazeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("daze"))
+	}))
+	defer dazeServer.Close()
+
+	// Borrow the self signed certificate of httptest.
+	certServer := httptest.NewTLSServer(nil)
+	certServer.Close()
+	cert := certServer.TLS.Certificates[0]
+	path := t.TempDir()
+	doa.Nil(os.WriteFile(filepath.Join(path, "cert.pem"), pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert.Certificate[0],
+	}), 0600))
+	doa.Nil(os.WriteFile(filepath.Join(path, "key.pem"), pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: doa.Try(x509.MarshalPKCS8PrivateKey(cert.PrivateKey)),
+	}), 0600))
+	list := NewLocaleMulti(DazeLocaleListenOn+"?cert="+filepath.Join(path, "cert.pem")+"&key="+
+		filepath.Join(path, "key.pem"), &Direct{}, nil)
+	locale := list[0]
+	doa.Doa(locale.Secure != nil)
+	defer locale.Close()
+	doa.Nil(locale.Run())
+
+	// Http proxy over tls.
+	cli := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(&url.URL{Scheme: "https", Host: DazeLocaleListenOn}),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	rep := doa.Try(cli.Get(dazeServer.URL))
+	doa.Doa(string(doa.Try(io.ReadAll(rep.Body))) == "daze")
+	rep.Body.Close()
+	cli.CloseIdleConnections()
+
+	// Socks5 over tls.
+	con := doa.Try(tls.Dial("tcp", DazeLocaleListenOn, &tls.Config{InsecureSkipVerify: true}))
+	defer con.Close()
+	buf := make([]byte, 16)
+	doa.Try(con.Write([]byte{0x05, 0x01, 0x00}))
+	doa.Try(io.ReadFull(con, buf[:2]))
+	doa.Doa(bytes.Equal(buf[:2], []byte{0x05, 0x00}))
+	doa.Try(con.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, 0x6d, 0xb1}))
+	doa.Try(io.ReadFull(con, buf[:10]))
+	doa.Doa(buf[1] == 0x00)
+	doa.Try(con.Write([]byte{0x00, 0x01, 0x00, 0x10}))
+	doa.Try(io.ReadFull(con, buf[:16]))
+	doa.Doa(bytes.Equal(buf[:16], bytes.Repeat([]byte{0x01}, 16)))
+
+	// Plain text is refused.
+	raw := doa.Try(net.Dial("tcp", DazeLocaleListenOn))
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(time.Second))
+	doa.Try(raw.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, 0x6d, 0xb1}))
+	_, err := io.ReadFull(raw, buf[:2])
+	doa.Doa(err != nil || !bytes.Equal(buf[:2], []byte{0x05, 0x00}))
+}
+
+func TestLocaleAccess(t *testing.T) {
+	access := NewAccess([]string{"192.168.1.0/24", "::1"}, []string{"192.168.1.13"})
+	doa.Doa(access.Check(&net.TCPAddr{IP: net.IPv4(192, 168, 1, 12)}))
+	doa.Doa(!access.Check(&net.TCPAddr{IP: net.IPv4(192, 168, 1, 13)}))
+	doa.Doa(!access.Check(&net.UDPAddr{IP: net.IPv4(192, 168, 2, 12)}))
+	doa.Doa(access.Check(&net.UDPAddr{IP: net.IPv6loopback}))
+	doa.Doa(access.Check(&net.UnixAddr{Name: "daze.sock"}))
+	doa.Doa((*Access)(nil).Check(&net.TCPAddr{IP: net.IPv4(192, 168, 2, 12)}))
+
+	dazeTester := NewTester(DazeTesterListenOn)
+	defer dazeTester.Close()
+	dazeTester.TCP()
+
+	list := NewLocaleMulti(DazeLocaleListenOn+"?deny=127.0.0.0/8", &Direct{}, nil)
+	locale := list[0]
+	doa.Nil(locale.Run())
+	deny := Expv.LocaleDeny.Value()
+	cli := doa.Try(net.Dial("tcp", DazeLocaleListenOn))
+	buf := make([]byte, 16)
+	doa.Try(cli.Write([]byte{0x05, 0x01, 0x00}))
+	_, err := io.ReadFull(cli, buf[:2])
+	doa.Doa(err != nil)
+	doa.Doa(Expv.LocaleDeny.Value() == deny+1)
+	cli.Close()
+	locale.Close()
+
+	list = NewLocaleMulti(DazeLocaleListenOn+"?allow=127.0.0.1", &Direct{}, nil)
+	locale = list[0]
+	doa.Nil(locale.Run())
+	defer locale.Close()
+	cli = doa.Try(net.Dial("tcp", DazeLocaleListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x05, 0x01, 0x00}))
+	doa.Try(io.ReadFull(cli, buf[:2]))
+	doa.Doa(bytes.Equal(buf[:2], []byte{0x05, 0x00}))
+}
+
+func TestLocalePac(t *testing.T) {
+	routerRules := NewRouterRules()
+	routerRules.L = append(routerRules.L, "*.cn")
+	routerRules.B = append(routerRules.B, "ads.*")
+	routerLocal := NewRouterIPNet()
+	routerRight := NewRouterRight(RoadRemote)
+	aimbot := &Aimbot{
+		Locale: &Direct{},
+		Remote: &Direct{},
+		Router: NewRouterCache(NewRouterChain(routerRules, routerLocal, routerRight)),
+	}
+	locale := NewLocale(DazeLocaleListenOn, aimbot)
+	defer locale.Close()
+	locale.Run()
+
+	for _, path := range []string{"/proxy.pac", "/wpad.dat"} {
+		rep := doa.Try(http.Get("http://" + DazeLocaleListenOn + path))
+		doa.Doa(rep.StatusCode == http.StatusOK)
+		doa.Doa(rep.Header.Get("Content-Type") == "application/x-ns-proxy-autoconfig")
+		out := doa.Try(io.ReadAll(rep.Body))
+		rep.Body.Close()
+		doa.Doa(bytes.HasPrefix(out, []byte("function FindProxyForURL(url, host) {")))
+		doa.Doa(bytes.Contains(out, []byte(`if (shExpMatch(host, "*.cn")) return "DIRECT";`)))
+		doa.Doa(bytes.Contains(out, []byte(`if (isInNet(ip, "192.168.0.0", "255.255.0.0")) return "DIRECT";`)))
+		doa.Doa(bytes.Contains(out, []byte(`return "PROXY 127.0.0.1:28080; SOCKS5 127.0.0.1:28080";`)))
+	}
+}
+
+func TestPacLiteral(t *testing.T) {
+	routerLocal := NewRouterIPNet()
+	routerLocal.Literal = true
+	out := Pac(NewRouterChain(routerLocal, NewRouterRight(RoadPuzzle)), "PROXY 127.0.0.1:28080")
+	doa.Doa(!strings.Contains(out, "dnsResolve"))
+	doa.Doa(strings.Contains(out, `if (isPlainHostName(host) || dnsDomainIs(host, ".local") || dnsDomainIs(host, ".localhost")) return "DIRECT";`))
+	doa.Doa(strings.Contains(out, `ip = /^\d+\.\d+\.\d+\.\d+$/.test(host) ? host : null;`))
+	doa.Doa(strings.Contains(out, `if (isInNet(ip, "192.168.0.0", "255.255.0.0")) return "DIRECT";`))
+	doa.Doa(strings.HasSuffix(out, "\treturn \"PROXY 127.0.0.1:28080\";\n}\n"))
+}
+
+func TestLocaleSocks5Bind(t *testing.T) {
+	locale := NewLocale(DazeLocaleListenOn, &Direct{})
+	defer locale.Close()
+	locale.Run()
+
+	buf := make([]byte, 10)
+	cli := doa.Try(net.Dial("tcp", DazeLocaleListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x05, 0x01, 0x00}))
+	doa.Try(io.ReadFull(cli, buf[:2]))
+	doa.Try(cli.Write([]byte{0x05, 0x02, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, 0x00, 0x00}))
+	doa.Try(io.ReadFull(cli, buf[:10]))
+	doa.Doa(bytes.Equal(buf[:8], []byte{0x05, 0x00, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01}))
+	bnd := &net.TCPAddr{IP: net.IP(buf[4:8]), Port: int(binary.BigEndian.Uint16(buf[8:10]))}
+
+	rmt := doa.Try(net.DialTCP("tcp", nil, bnd))
+	defer rmt.Close()
+	doa.Try(io.ReadFull(cli, buf[:10]))
+	doa.Doa(buf[1] == 0x00)
+	doa.Doa(int(binary.BigEndian.Uint16(buf[8:10])) == rmt.LocalAddr().(*net.TCPAddr).Port)
+
+	doa.Try(rmt.Write([]byte{0x00, 0x01, 0x02, 0x03}))
+	doa.Try(io.ReadFull(cli, buf[:4]))
+	doa.Doa(buf[3] == 0x03)
+
+	// An inbound connection from a host other than the destination is refused.
+	cli = doa.Try(net.Dial("tcp", DazeLocaleListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x05, 0x01, 0x00}))
+	doa.Try(io.ReadFull(cli, buf[:2]))
+	doa.Try(cli.Write([]byte{0x05, 0x02, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x02, 0x00, 0x00}))
+	doa.Try(io.ReadFull(cli, buf[:10]))
+	doa.Doa(buf[1] == 0x00)
+	bnd = &net.TCPAddr{IP: net.IP(buf[4:8]), Port: int(binary.BigEndian.Uint16(buf[8:10]))}
+	rmt = doa.Try(net.DialTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, bnd))
+	defer rmt.Close()
+	doa.Try(io.ReadFull(cli, buf[:10]))
+	doa.Doa(buf[1] == 0x02)
+}
+
+func TestLocaleSocks5UDP(t *testing.T) {
+	dazeTester := NewTester(DazeTesterListenOn)
+	defer dazeTester.Close()
+	dazeTester.UDP()
+
+	locale := NewLocale("[::1]:28080", &Direct{})
+	defer locale.Close()
+	doa.Nil(locale.Run())
+
+	buf := make([]byte, 64)
+	req := []byte{0x00, 0x00, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, 0x6d, 0xb1, 0x00, 0x01, 0x00, 0x10}
+
+	// The relay is bound on the address of the control connection, which is an ipv6 address.
+	cli := doa.Try(net.Dial("tcp", "[::1]:28080"))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x05, 0x01, 0x00}))
+	doa.Try(io.ReadFull(cli, buf[:2]))
+	doa.Try(cli.Write([]byte{0x05, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}))
+	doa.Try(io.ReadFull(cli, buf[:22]))
+	doa.Doa(bytes.Equal(buf[:4], []byte{0x05, 0x00, 0x00, 0x04}))
+	doa.Doa(net.IP(buf[4:20]).Equal(net.IPv6loopback))
+	bnd := &net.UDPAddr{IP: net.IPv6loopback, Port: int(binary.BigEndian.Uint16(buf[20:22]))}
+	app := doa.Try(net.DialUDP("udp", nil, bnd))
+	defer app.Close()
+	doa.Try(app.Write(req))
+	app.SetReadDeadline(time.Now().Add(time.Second))
+	n := doa.Try(app.Read(buf))
+	doa.Doa(bytes.Equal(buf[:n], append(bytes.Clone(req[:10]), bytes.Repeat([]byte{0x01}, 16)...)))
+
+	// Datagrams from a port other than the one hinted by the request are dropped.
+	cli = doa.Try(net.Dial("tcp", "[::1]:28080"))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x05, 0x01, 0x00}))
+	doa.Try(io.ReadFull(cli, buf[:2]))
+	doa.Try(cli.Write([]byte{0x05, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}))
+	doa.Try(io.ReadFull(cli, buf[:22]))
+	bnd = &net.UDPAddr{IP: net.IPv6loopback, Port: int(binary.BigEndian.Uint16(buf[20:22]))}
+	app = doa.Try(net.DialUDP("udp", nil, bnd))
+	defer app.Close()
+	doa.Try(app.Write(req))
+	app.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	_, err := app.Read(buf)
+	doa.Doa(errors.Is(err, os.ErrDeadlineExceeded))
+}
+
+func TestLocaleSocks5UDPLarge(t *testing.T) {
+	echo := doa.Try(net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	locale := NewLocale(DazeLocaleListenOn, &Direct{})
+	defer locale.Close()
+	doa.Nil(locale.Run())
+
+	buf := make([]byte, 65535)
+	cli := doa.Try(net.Dial("tcp", DazeLocaleListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x05, 0x01, 0x00}))
+	doa.Try(io.ReadFull(cli, buf[:2]))
+	doa.Try(cli.Write([]byte{0x05, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}))
+	doa.Try(io.ReadFull(cli, buf[:10]))
+	bnd := &net.UDPAddr{IP: net.IP(buf[4:8]), Port: int(binary.BigEndian.Uint16(buf[8:10]))}
+	app := doa.Try(net.DialUDP("udp", nil, bnd))
+	defer app.Close()
+	// Datagrams far larger than a mtu are relayed as a whole in both directions.
+	req := append([]byte{0x00, 0x00, 0x00}, Socks5Addr(echo.LocalAddr().String())...)
+	req = append(req, bytes.Repeat([]byte{0x01}, 8192)...)
+	doa.Try(app.Write(req))
+	app.SetReadDeadline(time.Now().Add(time.Second))
+	n := doa.Try(app.Read(buf))
+	doa.Doa(bytes.Equal(buf[:n], req))
+}
+
+func TestLinkIdle(t *testing.T) {
+	idle := Conf.LinkIdleTime
+	Conf.LinkIdleTime = time.Millisecond * 100
+	defer func() { Conf.LinkIdleTime = idle }()
+	// Links of the previous tests are torn down asynchronously after their clients leave.
+	for Expv.LinkLive.Value() != 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	cli, a := net.Pipe()
+	b, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+	done := make(chan struct{})
+	go func() {
+		Link(a, b)
+		close(done)
+	}()
+
+	// Traffic keeps the link alive.
+	buf := make([]byte, 4)
+	for range 4 {
+		time.Sleep(time.Millisecond * 50)
+		doa.Try(cli.Write([]byte("daze")))
+		doa.Try(io.ReadFull(srv, buf))
+	}
+	doa.Doa(Expv.LinkLive.Value() == 1)
+	select {
+	case <-done:
+		t.FailNow()
+	default:
+	}
+
+	// The link is torn down once it is idle.
+	<-done
+	doa.Doa(Expv.LinkLive.Value() == 0)
+	_, err := cli.Write([]byte("daze"))
+	doa.Doa(err != nil)
+}
+
+func TestSocks5Frag(t *testing.T) {
+	f := &Socks5Frag{}
+	_, ok := f.Push(0x01, "a:1", []byte{0x01})
+	doa.Doa(!ok)
+	_, ok = f.Push(0x02, "a:1", []byte{0x02})
+	doa.Doa(!ok)
+	b, ok := f.Push(0x83, "a:1", []byte{0x03})
+	doa.Doa(ok)
+	doa.Doa(bytes.Equal(b, []byte{0x01, 0x02, 0x03}))
+	// Missing fragment.
+	f.Push(0x01, "a:1", []byte{0x01})
+	_, ok = f.Push(0x83, "a:1", []byte{0x03})
+	doa.Doa(!ok)
+	// A lower position restarts the sequence.
+	f.Push(0x01, "a:1", []byte{0x01})
+	f.Push(0x02, "a:1", []byte{0x02})
+	f.Push(0x01, "a:1", []byte{0x04})
+	b, ok = f.Push(0x82, "a:1", []byte{0x05})
+	doa.Doa(ok)
+	doa.Doa(bytes.Equal(b, []byte{0x04, 0x05}))
+	// Different destination.
+	f.Push(0x01, "a:1", []byte{0x01})
+	_, ok = f.Push(0x82, "b:1", []byte{0x02})
+	doa.Doa(!ok)
+}
+
+func TestDnserv(t *testing.T) {
+	remote := NewDnserv(DazeTesterListenOn, &Direct{}, "", NewRouterRight(RoadFucked))
+	defer remote.Close()
+	doa.Nil(remote.Run())
+
+	routerRules := NewRouterRules()
+	routerRules.L = append(routerRules.L, "localhost")
+	dnserv := NewDnserv(DazeLocaleListenOn, &Direct{}, DazeTesterListenOn, routerRules)
+	defer dnserv.Close()
+	doa.Nil(dnserv.Run())
+
+	// Remote names are forwarded to the remote resolver, which blocks them all.
+	_, err := ResolverDns(DazeLocaleListenOn).LookupNetIP(context.Background(), "ip4", "daze.invalid")
+	dnsError := &net.DNSError{}
+	doa.Doa(errors.As(err, &dnsError) && dnsError.IsNotFound)
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0x6464, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("localhost."),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	})
+	req := doa.Try(b.Finish())
+
+	cli := doa.Try(net.Dial("tcp", DazeLocaleListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(req))), req...)))
+	buf := make([]byte, 2048)
+	doa.Try(io.ReadFull(cli, buf[:2]))
+	rep := buf[:binary.BigEndian.Uint16(buf[:2])]
+	doa.Try(io.ReadFull(cli, rep))
+	msg := dnsmessage.Message{}
+	doa.Nil(msg.Unpack(rep))
+	doa.Doa(msg.Header.ID == 0x6464)
+	doa.Doa(msg.Header.RCode == dnsmessage.RCodeSuccess)
+	doa.Doa(len(msg.Answers) != 0)
+	doa.Doa(msg.Answers[0].Body.(*dnsmessage.AResource).A == [4]byte{127, 0, 0, 1})
+}
+
+func TestFakeip(t *testing.T) {
+	fakeip := NewFakeip("198.18.0.0/15")
+	a := fakeip.Alloc("a.com")
+	doa.Doa(a == netip.MustParseAddr("198.18.0.1"))
+	doa.Doa(fakeip.Alloc("a.com") == a)
+	b := fakeip.Alloc("b.com")
+	doa.Doa(b == netip.MustParseAddr("198.18.0.2"))
+	name, ok := fakeip.Lookup(a)
+	doa.Doa(ok && name == "a.com")
+	doa.Doa(fakeip.Contains(netip.MustParseAddr("198.19.255.255")))
+	doa.Doa(!fakeip.Contains(netip.MustParseAddr("198.20.0.1")))
+
+	aimbot := &Aimbot{Fakeip: fakeip}
+	doa.Doa(doa.Try(aimbot.Reveal(&Context{}, "198.18.0.2:443")) == "b.com:443")
+	doa.Doa(doa.Try(aimbot.Reveal(&Context{}, "1.1.1.1:443")) == "1.1.1.1:443")
+	_, err := aimbot.Reveal(&Context{}, "198.18.0.3:443")
+	doa.Doa(err != nil)
+
+	// The pool has only 2 available addresses, so only 1 name is kept.
+	fakeip = NewFakeip("198.18.0.0/30")
+	a = fakeip.Alloc("a.com")
+	b = fakeip.Alloc("b.com")
+	doa.Doa(b == netip.MustParseAddr("198.18.0.2"))
+	_, ok = fakeip.Lookup(a)
+	doa.Doa(!ok)
+	doa.Doa(fakeip.Alloc("a.com") == a)
+}
+
 func TestResolverAll(t *testing.T) {
 	for _, url := range []string{
 		ResolverPublic.Alidns.Dns,
@@ -75,3 +687,396 @@ func TestResolverAll(t *testing.T) {
 		doa.Nil(err)
 	}
 }
+
+func FuzzLocaleServe(f *testing.F) {
+	f.Add([]byte{0x04, 0x01, 0x00, 0x50, 0x7f, 0x00, 0x00, 0x01, 0x00})
+	f.Add([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x03, 0x05, 'a', '.', 'c', 'o', 'm', 0x00, 0x50})
+	f.Add([]byte{0x05, 0x01, 0x02, 0x01, 0x01, 'u', 0x01, 'p', 0x05, 0x02, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, 0x00, 0x50})
+	f.Add([]byte("GET http://a.com/ HTTP/1.1\r\nHost: a.com\r\n\r\n"))
+	locale := NewLocale(DazeLocaleListenOn, &Aimbot{Router: NewRouterRight(RoadFucked)})
+	locale.Passwd = NewPasswd("u:p")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cli := &ReadWriteCloser{
+			Reader: bytes.NewReader(data),
+			Writer: io.Discard,
+			Closer: io.NopCloser(nil),
+		}
+		locale.Serve(&Context{}, cli)
+	})
+}
+
+func FuzzReadSocks4Request(f *testing.F) {
+	f.Add([]byte{0x04, 0x01, 0x00, 0x50, 0x7f, 0x00, 0x00, 0x01, 0x00})
+	f.Add([]byte{0x04, 0x01, 0x00, 0x50, 0x00, 0x00, 0x00, 0x01, 0x00, 'a', '.', 'c', 'o', 'm', 0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ReadSocks4Request(bufio.NewReader(bytes.NewReader(data)))
+	})
+}
+
+func FuzzReadSocks5Request(f *testing.F) {
+	f.Add([]byte{0x05, 0x01, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, 0x00, 0x50})
+	f.Add([]byte{0x05, 0x01, 0x00, 0x03, 0x05, 'a', '.', 'c', 'o', 'm', 0x00, 0x50})
+	f.Add([]byte{0x05, 0x03, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x50})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ReadSocks5Request(bytes.NewReader(data))
+	})
+}
+
+func FuzzParseSocks5UDP(f *testing.F) {
+	f.Add([]byte{0x00, 0x00, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, 0x00, 0x35, 0xff})
+	f.Add([]byte{0x00, 0x00, 0x81, 0x03, 0x05, 'a', '.', 'c', 'o', 'm', 0x00, 0x35, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _, n, err := ParseSocks5UDP(data)
+		if err == nil && n > len(data) {
+			t.FailNow()
+		}
+	})
+}
+
+func TestLinkHalfClose(t *testing.T) {
+	l := doa.Try(net.Listen("tcp", "127.0.0.1:0"))
+	defer l.Close()
+	pair := func() (net.Conn, net.Conn) {
+		c := doa.Try(net.Dial("tcp", l.Addr().String()))
+		return c, doa.Try(l.Accept())
+	}
+	cli, a := pair()
+	b, srv := pair()
+	defer cli.Close()
+	defer srv.Close()
+	done := make(chan struct{})
+	go func() {
+		Link(a, b)
+		close(done)
+	}()
+
+	// The client's fin reaches the server, while the reverse direction keeps flowing.
+	doa.Try(cli.Write([]byte("ping")))
+	doa.Nil(cli.(*net.TCPConn).CloseWrite())
+	doa.Doa(string(doa.Try(io.ReadAll(srv))) == "ping")
+	doa.Try(srv.Write([]byte("pong")))
+	doa.Nil(srv.(*net.TCPConn).CloseWrite())
+	doa.Doa(string(doa.Try(io.ReadAll(cli))) == "pong")
+	<-done
+}
+
+func TestLinkSplice(t *testing.T) {
+	l := doa.Try(net.Listen("tcp", "127.0.0.1:0"))
+	defer l.Close()
+	pair := func() (net.Conn, net.Conn) {
+		c := doa.Try(net.Dial("tcp", l.Addr().String()))
+		return c, doa.Try(l.Accept())
+	}
+	cli, a := pair()
+	b, srv := pair()
+	defer cli.Close()
+	defer srv.Close()
+	lim := rate.NewLimits(1024*1024, time.Second)
+	rwa := NewLimitsConn(&PrefixConn{ReadWriteCloser: a, Prefix: []byte{}}, lim)
+	tcp, ls := LinkSplice(rwa)
+	doa.Doa(tcp == a)
+	doa.Doa(len(ls) == 1)
+	tcp, _ = LinkSplice(&PrefixConn{ReadWriteCloser: a, Prefix: []byte{0x00}})
+	doa.Doa(tcp == nil)
+	done := make(chan struct{})
+	go func() {
+		Link(rwa, b)
+		close(done)
+	}()
+
+	buf := make([]byte, 1024*256)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	go func() {
+		doa.Try(cli.Write(buf))
+		doa.Nil(cli.(*net.TCPConn).CloseWrite())
+	}()
+	doa.Doa(bytes.Equal(doa.Try(io.ReadAll(srv)), buf))
+	srv.Close()
+	<-done
+}
+
+func TestLocaleSplice(t *testing.T) {
+	dazeTester := NewTester(DazeTesterListenOn)
+	defer dazeTester.Close()
+	dazeTester.TCP()
+
+	locale := NewLocale(DazeLocaleListenOn, &Direct{})
+	defer locale.Close()
+	doa.Nil(locale.Run())
+
+	// Both directions of a tunnel are spliced, whether it is opened by http connect or socks.
+	relay := func(cli io.ReadWriter, splice int64) {
+		buf := make([]byte, 128)
+		doa.Try(cli.Write([]byte{0x00, 0x01, 0x00, 0x80}))
+		doa.Try(io.ReadFull(cli, buf))
+		for i := 0; Expv.LinkSplice.Value() < splice+2; i++ {
+			doa.Doa(i < 200)
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	splice := Expv.LinkSplice.Value()
+	cli := doa.Try(net.Dial("tcp", DazeLocaleListenOn))
+	defer cli.Close()
+	cli.SetDeadline(time.Now().Add(time.Second * 4))
+	doa.Try(cli.Write([]byte("CONNECT " + DazeTesterListenOn + " HTTP/1.1\r\nHost: " + DazeTesterListenOn + "\r\n\r\n")))
+	cliReader := bufio.NewReader(cli)
+	rep := doa.Try(http.ReadResponse(cliReader, nil))
+	doa.Doa(rep.StatusCode == http.StatusOK)
+	relay(&ReadWriteCloser{Reader: cliReader, Writer: cli, Closer: cli}, splice)
+
+	buf := make([]byte, 10)
+	splice = Expv.LinkSplice.Value()
+	cli = doa.Try(net.Dial("tcp", DazeLocaleListenOn))
+	defer cli.Close()
+	cli.SetDeadline(time.Now().Add(time.Second * 4))
+	doa.Try(cli.Write([]byte{0x05, 0x01, 0x00}))
+	doa.Try(io.ReadFull(cli, buf[:2]))
+	doa.Try(cli.Write(append([]byte{0x05, 0x01, 0x00}, Socks5Addr(DazeTesterListenOn)...)))
+	doa.Try(io.ReadFull(cli, buf[:10]))
+	doa.Doa(buf[1] == 0x00)
+	relay(cli, splice)
+}
+
+func TestGlobs(t *testing.T) {
+	list := []string{"a.com", "*.b.com", "c.com", "*.c.com", "d.*", "e?.com", "*.f[ab].com", "*", "*.", "h\\.com"}
+	host := []string{
+		"a.com", "x.a.com", "b.com", "x.b.com", "x.y.b.com", ".b.com", "xb.com", "c.com", "x.c.com", "d.com", "d",
+		"e1.com", "e.com", "x.fa.com", "x.fc.com", "", ".", "h.com", "com", "a.com.",
+	}
+	for i := range list {
+		globs := NewGlobs(list[i : i+1])
+		for _, h := range host {
+			doa.Doa(globs.Match(h) == doa.Try(filepath.Match(list[i], h)))
+		}
+	}
+	globs := NewGlobs(list[:len(list)-3])
+	doa.Doa(len(globs.Rest) == 3)
+	for _, h := range host {
+		want := false
+		for _, e := range list[:len(list)-3] {
+			want = want || doa.Try(filepath.Match(e, h))
+		}
+		doa.Doa(globs.Match(h) == want)
+	}
+}
+
+func TestRouterRules(t *testing.T) {
+	r := NewRouterRules()
+	r.L = append(r.L, "*.a.com")
+	r.R = append(r.R, "x.a.com", "*.b.com")
+	r.B = append(r.B, "ads.*")
+	doa.Doa(r.Road(&Context{}, "x.a.com") == RoadLocale)
+	doa.Doa(r.Road(&Context{}, "x.b.com") == RoadRemote)
+	doa.Doa(r.Road(&Context{}, "ads.b.com") == RoadRemote)
+	doa.Doa(r.Road(&Context{}, "ads.c.com") == RoadFucked)
+	doa.Doa(r.Road(&Context{}, "c.com") == RoadPuzzle)
+	// Rules reloaded are compiled again.
+	name := filepath.Join(t.TempDir(), "rule.ls")
+	doa.Nil(os.WriteFile(name, []byte("L c.com\n"), 0644))
+	doa.Nil(r.Reload(name))
+	doa.Doa(r.Road(&Context{}, "c.com") == RoadLocale)
+	doa.Doa(r.Road(&Context{}, "x.a.com") == RoadPuzzle)
+	doa.Doa(r.Reload(name+".none") != nil)
+	doa.Doa(r.Road(&Context{}, "c.com") == RoadLocale)
+}
+
+// BenchmarkGlobsLinear matches hosts against 100k patterns one by one, as large as community blocklists.
+func BenchmarkGlobsLinear(b *testing.B) {
+	globs := make([]string, 100000)
+	for i := range globs {
+		globs[i] = fmt.Sprintf("%sdomain%d.com", []string{"*.", ""}[i%2], i)
+	}
+	for i := 0; b.Loop(); i++ {
+		host := fmt.Sprintf("www.domain%d.org", i%len(globs))
+		for _, e := range globs {
+			if doa.Try(filepath.Match(e, host)) {
+				break
+			}
+		}
+	}
+}
+
+// BenchmarkGlobsTrie matches hosts against 100k patterns compiled into globs.
+func BenchmarkGlobsTrie(b *testing.B) {
+	globs := make([]string, 100000)
+	for i := range globs {
+		globs[i] = fmt.Sprintf("%sdomain%d.com", []string{"*.", ""}[i%2], i)
+	}
+	g := NewGlobs(globs)
+	for i := 0; b.Loop(); i++ {
+		g.Match(fmt.Sprintf("www.domain%d.org", i%len(globs)))
+	}
+}
+
+func TestIPNets(t *testing.T) {
+	seed := uint64(time.Now().UnixNano())
+	t.Log("seed", seed)
+	r := rand.New(rand.NewPCG(seed, seed))
+	list := LoadReservedIP()
+	for range 1024 {
+		ip := make(net.IP, 4+12*r.IntN(2))
+		for i := range ip {
+			ip[i] = byte(r.Uint32())
+		}
+		list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(r.IntN(len(ip)*8+1), len(ip)*8)})
+	}
+	list = append(list, &net.IPNet{IP: net.ParseIP("1.2.3.0"), Mask: net.CIDRMask(120, 128)})
+	nets := NewIPNets(list)
+	for i := range len(nets.L) {
+		doa.Doa(nets.L[i].Compare(nets.R[i]) <= 0)
+		doa.Doa(i == 0 || nets.R[i-1].Compare(nets.L[i]) < 0)
+	}
+	for range 65536 {
+		ip := make(net.IP, 4+12*r.IntN(2))
+		for i := range ip {
+			ip[i] = byte(r.Uint32())
+		}
+		// Pick an address near a known ipnet from time to time, as random ones rarely hit small ipnets.
+		if r.IntN(2) == 0 {
+			ip = slices.Clone(list[r.IntN(len(list))].IP)
+			ip[len(ip)-1] += byte(r.IntN(3)) - 1
+		}
+		want := false
+		for _, e := range list {
+			want = want || e.Contains(ip)
+		}
+		doa.Doa(nets.Contains(ip) == want)
+		doa.Doa(nets.Contains(ip.To16()) == want)
+	}
+}
+
+// BenchmarkIPNetsLinear looks up ips in 10k ipnets one by one, as large as the default rule.cidr.
+func BenchmarkIPNetsLinear(b *testing.B) {
+	list := make([]*net.IPNet, 10000)
+	for i := range list {
+		list[i] = &net.IPNet{IP: net.IPv4(byte(i>>8), byte(i), 0, 0).To4(), Mask: net.CIDRMask(16, 32)}
+	}
+	for i := 0; b.Loop(); i++ {
+		ip := net.IPv4(byte(i>>8)|0x80, byte(i), 0, 1)
+		for _, e := range list {
+			if e.Contains(ip) {
+				break
+			}
+		}
+	}
+}
+
+// BenchmarkIPNetsSearch looks up ips in 10k ipnets compiled into sorted ranges.
+func BenchmarkIPNetsSearch(b *testing.B) {
+	list := make([]*net.IPNet, 10000)
+	for i := range list {
+		list[i] = &net.IPNet{IP: net.IPv4(byte(i>>8), byte(i), 0, 0).To4(), Mask: net.CIDRMask(16, 32)}
+	}
+	nets := NewIPNets(list)
+	for i := 0; b.Loop(); i++ {
+		nets.Contains(net.IPv4(byte(i>>8)|0x80, byte(i), 0, 1))
+	}
+}
+
+func TestRouterIPNetPolicy(t *testing.T) {
+	_, l, _ := net.ParseCIDR("10.0.0.0/8")
+	_, r, _ := net.ParseCIDR("2001:db8::/32")
+	router := &RouterIPNet{L: []*net.IPNet{l}, R: []*net.IPNet{r}}
+	ip6 := net.IPAddr{IP: net.ParseIP("2001:db8::1")}
+	ip4 := net.IPAddr{IP: net.ParseIP("10.0.0.1")}
+	for _, e := range []struct {
+		policy Policy
+		addr   net.IPAddr
+		road   Road
+	}{
+		{PolicyFirst, ip6, RoadRemote},
+		{PolicyAnyLocal, ip4, RoadLocale},
+		{PolicyAllLocal, ip6, RoadRemote},
+		{PolicyPrefer4, ip4, RoadLocale},
+		{PolicyPrefer6, ip6, RoadRemote},
+	} {
+		doa.Doa(doa.Try(ParsePolicy(e.policy.String())) == e.policy)
+		router.Policy = e.policy
+		a, c := router.Pick([]net.IPAddr{ip6, ip4})
+		doa.Doa(a.IP.Equal(e.addr.IP))
+		doa.Doa(c == e.road)
+	}
+	doa.Doa(doa.Err(ParsePolicy("last")) != nil)
+	router.Policy = PolicyAllLocal
+	_, c := router.Pick([]net.IPAddr{ip4, ip4})
+	doa.Doa(c == RoadLocale)
+
+	// The evaluated ip is cached with the road, so every connection to a host dials the ip that decided its road.
+	count := &routerCount{M: map[string]Road{"a.com": RoadLocale}}
+	aimbot := &Aimbot{Router: NewRouterCache(count)}
+	for range 2 {
+		ctx := &Context{}
+		doa.Doa(aimbot.Router.Road(ctx, "a.com") == RoadLocale)
+		doa.Doa(aimbot.Target(ctx, "a.com:80", "80") == "10.0.0.1:80")
+	}
+	doa.Doa(count.N == 1)
+}
+
+func TestRouterIPNetLiteral(t *testing.T) {
+	_, l, _ := net.ParseCIDR("10.0.0.0/8")
+	router := &RouterIPNet{L: []*net.IPNet{l}, Literal: true}
+	call := Expv.RouterIPNetCall.Value()
+	doa.Doa(router.Road(&Context{}, "example.com") == RoadPuzzle)
+	doa.Doa(Expv.RouterIPNetCall.Value() == call)
+	doa.Doa(router.Road(&Context{}, "10.0.0.1") == RoadLocale)
+	doa.Doa(router.Road(&Context{}, "::1") == RoadPuzzle)
+	chain := NewRouterChain(router, NewRouterRight(RoadRemote))
+	doa.Doa(chain.Road(&Context{}, "example.com") == RoadRemote)
+	// Local names never resolve on the remote side, they stay local without a dns query.
+	call = Expv.RouterIPNetCall.Value()
+	for _, e := range []string{"localhost", "LocalHost.", "nas", "printer.local", "app.localhost"} {
+		doa.Doa(chain.Road(&Context{}, e) == RoadLocale)
+	}
+	doa.Doa(chain.Road(&Context{}, "local.example.com") == RoadRemote)
+	doa.Doa(Expv.RouterIPNetCall.Value() == call)
+}
+
+// routerCount counts the calls to a router, and routes hosts by a map. Each call evaluates a different ip.
+type routerCount struct {
+	M map[string]Road
+	N int
+}
+
+func (r *routerCount) Road(ctx *Context, host string) Road {
+	r.N++
+	road, ok := r.M[host]
+	if !ok {
+		ctx.Rer = errors.New("daze: no such host")
+		return RoadPuzzle
+	}
+	ctx.Rip = netip.AddrFrom4([4]byte{10, 0, 0, byte(r.N)})
+	return road
+}
+
+func TestRouterCacheExpire(t *testing.T) {
+	pass, fail := Conf.RouterPassTTL, Conf.RouterFailTTL
+	defer func() {
+		Conf.RouterPassTTL, Conf.RouterFailTTL = pass, fail
+	}()
+	Conf.RouterPassTTL = time.Hour
+	Conf.RouterFailTTL = time.Millisecond * 50
+	count := &routerCount{M: map[string]Road{"a.com": RoadLocale}}
+	rules := NewRouterRules()
+	cache := NewRouterCache(NewRouterChain(rules, count))
+	expi := Expv.RouterCacheExpi.Value()
+	wipe := Expv.RouterCacheWipe.Value()
+	for range 2 {
+		doa.Doa(cache.Road(&Context{}, "a.com") == RoadLocale)
+		doa.Doa(cache.Road(&Context{}, "b.com") == RoadPuzzle)
+	}
+	doa.Doa(count.N == 2)
+	time.Sleep(time.Millisecond * 60)
+	doa.Doa(cache.Road(&Context{}, "a.com") == RoadLocale)
+	doa.Doa(cache.Road(&Context{}, "b.com") == RoadPuzzle)
+	doa.Doa(count.N == 3)
+	doa.Doa(Expv.RouterCacheExpi.Value() == expi+1)
+	name := filepath.Join(t.TempDir(), "rule.ls")
+	doa.Nil(os.WriteFile(name, []byte("R a.com\n"), 0644))
+	doa.Nil(RouterReload(cache, &AimbotOption{Type: "rule", Rule: name}))
+	doa.Doa(cache.Road(&Context{}, "a.com") == RoadRemote)
+	doa.Doa(count.N == 3)
+	doa.Doa(Expv.RouterCacheWipe.Value() == wipe+1)
+}
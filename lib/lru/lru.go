@@ -3,6 +3,7 @@ package lru
 
 import (
 	"sync"
+	"time"
 )
 
 // Elem is an element of a linked list.
@@ -10,6 +11,8 @@ type Elem[K comparable, V any] struct {
 	Next, Prev *Elem[K, V]
 	K          K
 	V          V
+	// T is the time the elem expires at. Zero means it never expires.
+	T time.Time
 }
 
 // List represents a doubly linked list.
@@ -64,6 +67,8 @@ func (l *List[K, V]) Update(e *Elem[K, V]) {
 type Lru[K comparable, V any] struct {
 	// Drop is called automatically when an elem is deleted.
 	Drop func(k K, v V)
+	// Expire is called automatically when an elem is deleted since it has expired, right after drop.
+	Expire func(k K, v V)
 	// Size is the maximum number of cache entries before an item is evicted. Zero means no limit.
 	Size int
 	List *List[K, V]
@@ -88,6 +93,13 @@ func (l *Lru[K, V]) GetExists(k K) (v V, ok bool) {
 	defer l.M.Unlock()
 	var e *Elem[K, V]
 	e, ok = l.C[k]
+	if ok && !e.T.IsZero() && !time.Now().Before(e.T) {
+		l.Drop(k, e.V)
+		l.Expire(k, e.V)
+		delete(l.C, k)
+		l.List.Remove(e)
+		ok = false
+	}
 	if ok {
 		l.List.Update(e)
 		v = e.V
@@ -101,15 +113,15 @@ func (l *Lru[K, V]) Get(k K) (v V) {
 	return
 }
 
-// Has returns true if a key exists.
+// Has returns true if a key exists and has not expired.
 func (l *Lru[K, V]) Has(k K) bool {
 	l.M.Lock()
 	defer l.M.Unlock()
-	_, b := l.C[k]
-	return b
+	e, b := l.C[k]
+	return b && (e.T.IsZero() || time.Now().Before(e.T))
 }
 
-// Len returns the number of items in the cache.
+// Len returns the number of items in the cache. Expired items are counted until they are looked up or evicted.
 func (l *Lru[K, V]) Len() int {
 	l.M.Lock()
 	defer l.M.Unlock()
@@ -118,12 +130,22 @@ func (l *Lru[K, V]) Len() int {
 
 // Set adds a value to the cache.
 func (l *Lru[K, V]) Set(k K, v V) {
+	l.SetExpire(k, v, 0)
+}
+
+// SetExpire adds a value to the cache, which expires after the duration d. If d is zero, it never expires.
+func (l *Lru[K, V]) SetExpire(k K, v V, d time.Duration) {
 	l.M.Lock()
 	defer l.M.Unlock()
+	t := time.Time{}
+	if d != 0 {
+		t = time.Now().Add(d)
+	}
 	if e, ok := l.C[k]; ok {
 		l.List.Update(e)
 		e.K = k
 		e.V = v
+		e.T = t
 		return
 	}
 	if l.List.Size == l.Size {
@@ -131,16 +153,28 @@ func (l *Lru[K, V]) Set(k K, v V) {
 		delete(l.C, l.List.Root.Prev.K)
 		l.List.Remove(l.List.Root.Prev)
 	}
-	l.C[k] = l.List.Insert(&Elem[K, V]{K: k, V: v})
+	l.C[k] = l.List.Insert(&Elem[K, V]{K: k, V: v, T: t})
+}
+
+// Clear removes all items from the cache.
+func (l *Lru[K, V]) Clear() {
+	l.M.Lock()
+	defer l.M.Unlock()
+	for l.List.Size != 0 {
+		l.Drop(l.List.Root.Prev.K, l.List.Root.Prev.V)
+		delete(l.C, l.List.Root.Prev.K)
+		l.List.Remove(l.List.Root.Prev)
+	}
 }
 
 // New returns a new LRU cache. If size is zero, the cache has no limit.
 func New[K comparable, V any](size int) *Lru[K, V] {
 	return &Lru[K, V]{
-		Drop: func(k K, v V) {},
-		Size: size,
-		List: new(List[K, V]).Init(),
-		C:    map[K]*Elem[K, V]{},
-		M:    &sync.Mutex{},
+		Drop:   func(k K, v V) {},
+		Expire: func(k K, v V) {},
+		Size:   size,
+		List:   new(List[K, V]).Init(),
+		C:      map[K]*Elem[K, V]{},
+		M:      &sync.Mutex{},
 	}
 }
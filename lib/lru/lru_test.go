@@ -2,6 +2,7 @@ package lru
 
 import (
 	"testing"
+	"time"
 )
 
 func TestLruAppend(t *testing.T) {
@@ -72,3 +73,43 @@ func TestLruSize(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestLruExpire(t *testing.T) {
+	c := New[int, int](4)
+	n := 0
+	c.Expire = func(k int, v int) {
+		n++
+	}
+	c.SetExpire(1, 1, time.Millisecond)
+	c.SetExpire(2, 2, time.Hour)
+	c.Set(3, 3)
+	time.Sleep(time.Millisecond * 2)
+	if c.Has(1) || !c.Has(2) || !c.Has(3) {
+		t.FailNow()
+	}
+	if _, ok := c.GetExists(1); ok || n != 1 || c.Len() != 2 {
+		t.FailNow()
+	}
+	c.SetExpire(2, 4, 0)
+	if c.Get(2) != 4 || c.Get(3) != 3 || n != 1 {
+		t.FailNow()
+	}
+}
+
+func TestLruClear(t *testing.T) {
+	c := New[int, int](4)
+	n := 0
+	c.Drop = func(k int, v int) {
+		n++
+	}
+	c.Set(1, 1)
+	c.Set(2, 2)
+	c.Clear()
+	if c.List.Size != c.Len() || c.Len() != 0 || len(c.C) != 0 || n != 2 {
+		t.FailNow()
+	}
+	c.Set(3, 3)
+	if c.Get(3) != 3 {
+		t.FailNow()
+	}
+}
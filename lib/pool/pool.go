@@ -0,0 +1,51 @@
+// Package pool implements size-classed byte buffers shared across goroutines.
+//
+// Ownership rules: a buffer returned by Get belongs to the caller until it is passed to Put. After Put, neither the
+// buffer nor any slice of it may be read or written again. A buffer must be put back at most once, and only by its
+// owner. A buffer that is never put back is simply collected by the gc.
+package pool
+
+import (
+	"math/bits"
+	"sync"
+	"unsafe"
+)
+
+const (
+	// The smallest size class is 2^minBits bytes.
+	minBits = 9
+	// The largest size class is 2^maxBits bytes. It holds the largest udp datagram with a header in front of it.
+	maxBits = 17
+)
+
+// The pools store pointers to the first byte of buffers rather than slices, so Put does not allocate.
+var pools [maxBits - minBits + 1]sync.Pool
+
+// class returns the index of the smallest size class that holds n bytes.
+func class(n int) int {
+	if n <= 1<<minBits {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - minBits
+}
+
+// Get returns a buffer of length n. Buffers larger than the largest size class are allocated directly.
+func Get(n int) []byte {
+	if n > 1<<maxBits {
+		return make([]byte, n)
+	}
+	i := class(n)
+	if p, ok := pools[i].Get().(*byte); ok {
+		return unsafe.Slice(p, 1<<(i+minBits))[:n]
+	}
+	return make([]byte, n, 1<<(i+minBits))
+}
+
+// Put puts the buffer returned by Get back to the pool. Buffers whose capacity is not a size class are dropped.
+func Put(b []byte) {
+	c := cap(b)
+	if c < 1<<minBits || c > 1<<maxBits || c&(c-1) != 0 {
+		return
+	}
+	pools[class(c)].Put(unsafe.SliceData(b[:c]))
+}
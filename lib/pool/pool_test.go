@@ -0,0 +1,50 @@
+package pool
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/libraries/daze/lib/doa"
+)
+
+func TestPool(t *testing.T) {
+	for _, n := range []int{0, 1, 512, 513, 2048, 65535, 65536 + 262, 1 << 17} {
+		b := Get(n)
+		doa.Doa(len(b) == n)
+		doa.Doa(cap(b) >= 512)
+		doa.Doa(cap(b)&(cap(b)-1) == 0)
+		doa.Doa(cap(b) == 512 || cap(b)/2 < n)
+		Put(b)
+	}
+	b := Get(1<<17 + 1)
+	doa.Doa(len(b) == 1<<17+1)
+	Put(b)
+	Put(make([]byte, 1000))
+}
+
+// benchmarkBuffers simulates many concurrent streams, each of them takes a buffer for every packet it relays.
+func benchmarkBuffers(b *testing.B, get func() []byte, put func([]byte)) {
+	b.ReportAllocs()
+	m := runtime.MemStats{}
+	runtime.ReadMemStats(&m)
+	gc := m.NumGC
+	b.SetParallelism(64)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buf := get()
+			buf[0] = 0x01
+			buf[len(buf)-1] = 0x01
+			put(buf)
+		}
+	})
+	runtime.ReadMemStats(&m)
+	b.ReportMetric(float64(m.NumGC-gc)/float64(b.N), "gc/op")
+}
+
+func BenchmarkPoolGet(b *testing.B) {
+	benchmarkBuffers(b, func() []byte { return Get(2048) }, Put)
+}
+
+func BenchmarkPoolMake(b *testing.B) {
+	benchmarkBuffers(b, func() []byte { return make([]byte, 2048) }, func([]byte) {})
+}
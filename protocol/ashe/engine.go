@@ -13,6 +13,7 @@ import (
 	"github.com/libraries/daze"
 	"github.com/libraries/daze/lib/doa"
 	"github.com/libraries/daze/lib/expvpp"
+	"github.com/libraries/daze/lib/pool"
 	"github.com/libraries/daze/lib/rate"
 )
 
@@ -32,6 +33,7 @@ import (
 // - Time    : Timestamp of request. The server will reject requests with past or future timestamps to prevent replay
 //             attacks
 // - Net     : 0x01 : TCP
+//             0x02 : TCP BIND
 //             0x03 : UDP
 // - Dst.Len : Destination address's length
 // - Dst     : Destination address
@@ -46,6 +48,17 @@ import (
 //
 // - Code: 0x00: Succeed
 //         0x01: General server failure
+//
+// For a BIND request, Dst is the address of the peer that is expected to connect. The server listens on an ephemeral
+// port and returns two replies. The first one is sent when the listener is ready, and carries its address. The second
+// one is sent when the inbound connection arrives, and carries the address of the peer. After that, the channel is
+// linked to the inbound connection. On failure, Bnd.Len is zero.
+//
+// +------+---------+---------+
+// | Code | Bnd.Len | Bnd     |
+// +------+---------+---------+
+// |  1   | 1       | 0 - 255 |
+// +------+---------+---------+
 
 // Conf is acting as package level configuration.
 var Conf = struct {
@@ -72,6 +85,11 @@ func NewTCPConn(c io.ReadWriteCloser) *TCPConn {
 	return &TCPConn{c}
 }
 
+// CloseWrite shuts down the writing side of the underlying connection.
+func (c *TCPConn) CloseWrite() error {
+	return daze.CloseWrite(c.ReadWriteCloser)
+}
+
 // UDPConn is an implementation of the Conn interface for udp network connections.
 type UDPConn struct {
 	io.ReadWriteCloser
@@ -99,7 +117,8 @@ func (c *UDPConn) Write(p []byte) (int, error) {
 	// Maximum udp payload size is 65527(equal to 65535 - 8) bytes in theoretically. The 8 in the formula means the udp
 	// header, which contains source port, destination port, length and checksum.
 	doa.Doa(len(p) <= 65527)
-	b := make([]byte, 2+len(p))
+	b := pool.Get(2 + len(p))
+	defer pool.Put(b)
 	binary.BigEndian.PutUint16(b, uint16(len(p)))
 	copy(b[2:], p)
 	n, err := c.ReadWriteCloser.Write(b)
@@ -109,6 +128,70 @@ func (c *UDPConn) Write(p []byte) (int, error) {
 	return n - 2, nil
 }
 
+// Bound is an implementation of the daze.Bound interface for ashe BIND requests.
+type Bound struct {
+	bnd string
+	con io.ReadWriteCloser
+	lim *rate.Limits
+}
+
+// Accept implements daze.Bound.
+func (b *Bound) Accept() (io.ReadWriteCloser, string, error) {
+	rem, err := ReadBind(b.con)
+	if err != nil {
+		return nil, "", err
+	}
+	var con io.ReadWriteCloser = NewTCPConn(b.con)
+	if b.lim != nil {
+		con = daze.NewLimitsConn(con, b.lim)
+	}
+	return con, rem, nil
+}
+
+// Addr implements daze.Bound.
+func (b *Bound) Addr() string {
+	return b.bnd
+}
+
+// Close implements daze.Bound.
+func (b *Bound) Close() error {
+	return b.con.Close()
+}
+
+// ReadBind reads a reply of BIND request and returns the address carried in it.
+func ReadBind(r io.Reader) (string, error) {
+	buf := make([]byte, 2)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return "", err
+	}
+	code := buf[0]
+	buf = make([]byte, buf[1])
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case code == 0:
+	case code == 1:
+		return "", errors.New("daze: general server failure")
+	case code >= 2:
+		return "", errors.New("daze: receive error response")
+	}
+	return string(buf), nil
+}
+
+// WriteBind writes a reply of BIND request.
+func WriteBind(w io.Writer, code uint8, address string) error {
+	doa.Doa(len(address) <= 255)
+	buf := make([]byte, 2+len(address))
+	buf[0] = code
+	buf[1] = uint8(len(address))
+	copy(buf[2:], address)
+	_, err := w.Write(buf)
+	return err
+}
+
 // Server implemented the ashe protocol. The ashe server will typically evaluate the request based on source and
 // destination addresses, and return one or more reply messages, as appropriate for the request type.
 type Server struct {
@@ -182,6 +265,9 @@ func (s *Server) Serve(ctx *daze.Context, cli io.ReadWriteCloser) error {
 		return err
 	}
 	dst = string(buf)
+	if dstNet == 0x02 {
+		return s.ServeBind(ctx, con, dst)
+	}
 	switch dstNet {
 	case 0x01:
 		log.Printf("conn: %08x   dial network=tcp address=%s", ctx.Cid, dst)
@@ -205,6 +291,34 @@ func (s *Server) Serve(ctx *daze.Context, cli io.ReadWriteCloser) error {
 	return nil
 }
 
+// ServeBind serves a BIND request. It listens on an ephemeral port and links the inbound connection from dst with con.
+func (s *Server) ServeBind(ctx *daze.Context, con io.ReadWriteCloser, dst string) error {
+	log.Printf("conn: %08x   bind network=tcp address=%s", ctx.Cid, dst)
+	bnd, err := (&daze.Direct{}).Bind(ctx, "tcp", dst)
+	if err != nil {
+		WriteBind(con, 1, "")
+		return err
+	}
+	defer bnd.Close()
+	err = WriteBind(con, 0, bnd.Addr())
+	if err != nil {
+		return err
+	}
+	srv, rem, err := bnd.Accept()
+	if err != nil {
+		WriteBind(con, 1, "")
+		return err
+	}
+	log.Printf("conn: %08x   bind remote=%s", ctx.Cid, rem)
+	err = WriteBind(con, 0, rem)
+	if err != nil {
+		srv.Close()
+		return err
+	}
+	daze.Link(NewTCPConn(con), srv)
+	return nil
+}
+
 // Close listener. Established connections will not be closed.
 func (s *Server) Close() error {
 	if s.Closer != nil {
@@ -235,11 +349,7 @@ func (s *Server) Run() error {
 			idx++
 			ctx := &daze.Context{Cid: idx}
 			log.Printf("conn: %08x accept remote=%s", ctx.Cid, cli.RemoteAddr())
-			rtc := &daze.ReadWriteCloser{
-				Reader: io.TeeReader(cli, rate.NewLimitsWriter(s.Limits)),
-				Writer: io.MultiWriter(cli, rate.NewLimitsWriter(s.Limits)),
-				Closer: cli,
-			}
+			rtc := daze.NewLimitsConn(cli, s.Limits)
 			go func() {
 				defer rtc.Close()
 				if err := s.Serve(ctx, rtc); err != nil {
@@ -349,6 +459,55 @@ func (c *Client) Estab(ctx *daze.Context, srv io.ReadWriteCloser, network string
 	panic("unreachable")
 }
 
+// EstabBind establishes a BIND request on an existing connection. It is the caller's responsibility to close the
+// returned Bound.
+func (c *Client) EstabBind(ctx *daze.Context, srv io.ReadWriteCloser, network string, address string) (*Bound, error) {
+	var (
+		bnd string
+		buf []byte
+		con io.ReadWriteCloser
+		err error
+		n   = len(address)
+	)
+	if n > 255 {
+		return nil, fmt.Errorf("daze: destination address too long %s", address)
+	}
+	if network != "tcp" {
+		return nil, fmt.Errorf("daze: network must be tcp")
+	}
+	con, err = c.Hello(srv)
+	if err != nil {
+		return nil, err
+	}
+	buf = make([]byte, 2+len(address))
+	buf[0] = 0x02
+	buf[1] = uint8(n)
+	copy(buf[2:], []byte(address))
+	_, err = con.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+	bnd, err = ReadBind(con)
+	if err != nil {
+		return nil, err
+	}
+	return &Bound{bnd: bnd, con: con, lim: c.Limits}, nil
+}
+
+// Bind asks the server to wait for an inbound connection from the address.
+func (c *Client) Bind(ctx *daze.Context, network string, address string) (daze.Bound, error) {
+	srv, err := daze.Dial("tcp", c.Server)
+	if err != nil {
+		return nil, err
+	}
+	bnd, err := c.EstabBind(ctx, srv, network, address)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	return bnd, nil
+}
+
 // Dial connects to the address on the named network.
 func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
 	srv, err := daze.Dial("tcp", c.Server)
@@ -360,11 +519,7 @@ func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.Rea
 		srv.Close()
 		return nil, err
 	}
-	rtc := &daze.ReadWriteCloser{
-		Reader: io.TeeReader(con, rate.NewLimitsWriter(c.Limits)),
-		Writer: io.MultiWriter(con, rate.NewLimitsWriter(c.Limits)),
-		Closer: con,
-	}
+	rtc := daze.NewLimitsConn(con, c.Limits)
 	return rtc, nil
 }
 
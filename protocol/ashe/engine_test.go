@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"io"
 	"math/rand/v2"
+	"net"
 	"testing"
 
 	"github.com/libraries/daze"
@@ -125,3 +126,45 @@ func TestProtocolAsheUDP(t *testing.T) {
 	buf := make([]byte, 128)
 	doa.Try(io.ReadFull(cli, buf[:128]))
 }
+
+func TestProtocolAsheBind(t *testing.T) {
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	ctx := &daze.Context{}
+	bnd := doa.Try(dazeClient.Bind(ctx, "tcp", "127.0.0.1:0"))
+	defer bnd.Close()
+
+	rmt := doa.Try(net.Dial("tcp", bnd.Addr()))
+	defer rmt.Close()
+	cli, rem, err := bnd.Accept()
+	doa.Nil(err)
+	defer cli.Close()
+	doa.Doa(rem == rmt.LocalAddr().String())
+
+	buf := make([]byte, 4)
+	doa.Try(rmt.Write([]byte{0x00, 0x01, 0x02, 0x03}))
+	doa.Try(io.ReadFull(cli, buf))
+	doa.Doa(buf[3] == 0x03)
+	doa.Try(cli.Write([]byte{0x04, 0x05, 0x06, 0x07}))
+	doa.Try(io.ReadFull(rmt, buf))
+	doa.Doa(buf[3] == 0x07)
+}
+
+func TestProtocolAsheBindPeer(t *testing.T) {
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	ctx := &daze.Context{}
+	bnd := doa.Try(dazeClient.Bind(ctx, "tcp", "127.0.0.2:0"))
+	defer bnd.Close()
+
+	rmt := doa.Try(net.Dial("tcp", bnd.Addr()))
+	defer rmt.Close()
+	_, _, err := bnd.Accept()
+	doa.Doa(err != nil)
+}
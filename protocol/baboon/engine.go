@@ -79,11 +79,7 @@ func (s *Server) ServeDaze(w http.ResponseWriter, r *http.Request) {
 	spy := &ashe.Server{Cipher: s.Cipher}
 	ctx := &daze.Context{Cid: atomic.AddUint32(&s.NextID, 1)}
 	log.Printf("conn: %08x accept remote=%s", ctx.Cid, cc.RemoteAddr())
-	rtc := &daze.ReadWriteCloser{
-		Reader: io.TeeReader(cli, rate.NewLimitsWriter(s.Limits)),
-		Writer: io.MultiWriter(cli, rate.NewLimitsWriter(s.Limits)),
-		Closer: cli,
-	}
+	rtc := daze.NewLimitsConn(cli, s.Limits)
 	if err := spy.Serve(ctx, rtc); err != nil {
 		log.Printf("conn: %08x  error %s", ctx.Cid, err)
 	}
@@ -164,8 +160,8 @@ type Client struct {
 	Server string
 }
 
-// Dial connects to the address on the named network.
-func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+// Open connects to the server and degenerates the http connection, ashe protocol can be run on the returned conn.
+func (c *Client) Open() (io.ReadWriteCloser, error) {
 	var (
 		buf []byte
 		err error
@@ -187,17 +183,37 @@ func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.Rea
 	// Discard responded header
 	buf = make([]byte, 147)
 	io.ReadFull(srv, buf)
+	return srv, nil
+}
+
+// Bind asks the server to wait for an inbound connection from the address.
+func (c *Client) Bind(ctx *daze.Context, network string, address string) (daze.Bound, error) {
+	srv, err := c.Open()
+	if err != nil {
+		return nil, err
+	}
+	spy := &ashe.Client{Cipher: c.Cipher, Limits: c.Limits}
+	bnd, err := spy.EstabBind(ctx, srv, network, address)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	return bnd, nil
+}
+
+// Dial connects to the address on the named network.
+func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+	srv, err := c.Open()
+	if err != nil {
+		return nil, err
+	}
 	spy := &ashe.Client{Cipher: c.Cipher}
 	con, err := spy.Estab(ctx, srv, network, address)
 	if err != nil {
 		srv.Close()
 		return nil, err
 	}
-	rtc := &daze.ReadWriteCloser{
-		Reader: io.TeeReader(con, rate.NewLimitsWriter(c.Limits)),
-		Writer: io.MultiWriter(con, rate.NewLimitsWriter(c.Limits)),
-		Closer: con,
-	}
+	rtc := daze.NewLimitsConn(con, c.Limits)
 	return rtc, nil
 }
 
@@ -37,6 +37,13 @@ import (
 // +-----+-----+-----+-----+
 // | 0x3 | Ask |    Rsv    |
 // +-----+-----+-----+-----+
+// | 0x4 | Sid |    Rsv    |
+// +-----+-----+-----+-----+
+//
+// Frame 0x3 is a keep-alive probe if Ask is 0x00, and its reply if Ask is 0x01. With Ask 0x02, it is sent once by each
+// side when the mux starts, to announce that frame 0x4 is understood. Frame 0x4 shuts down the writing side of a
+// stream, it is sent only to peers that have announced it. Older peers ignore both the announcement and unknown
+// frames, so a half close to them falls back to a full close of the stream.
 
 // Conf is acting as package level configuration.
 var Conf = struct {
@@ -107,11 +114,7 @@ func (s *Server) Run() error {
 				}
 				break
 			}
-			rtc := &daze.ReadWriteCloser{
-				Reader: io.TeeReader(cli, rate.NewLimitsWriter(s.Limits)),
-				Writer: io.MultiWriter(cli, rate.NewLimitsWriter(s.Limits)),
-				Closer: cli,
-			}
+			rtc := daze.NewLimitsConn(cli, s.Limits)
 			mux := NewMuxServer(rtc)
 			go func() {
 				defer mux.Close()
@@ -158,8 +161,8 @@ func (c *Client) Close() error {
 	return nil
 }
 
-// Dial connects to the address on the named network.
-func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+// Open a new stream on the established mux.
+func (c *Client) Open() (*Stream, error) {
 	select {
 	case mux := <-c.Mux:
 		srv, err := mux.Open()
@@ -167,21 +170,41 @@ func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.Rea
 			return nil, err
 		}
 		log.Printf("czar: mux slot stream id=0x%02x", srv.idx)
-		spy := &ashe.Client{Cipher: c.Cipher}
-		con, err := spy.Estab(ctx, srv, network, address)
-		if err != nil {
-			srv.Close()
-			return nil, err
-		}
-		rtc := &daze.ReadWriteCloser{
-			Reader: io.TeeReader(con, rate.NewLimitsWriter(c.Limits)),
-			Writer: io.MultiWriter(con, rate.NewLimitsWriter(c.Limits)),
-			Closer: con,
-		}
-		return rtc, nil
+		return srv, nil
 	case <-time.After(daze.Conf.DialerTimeout):
-		return nil, fmt.Errorf("dial tcp: %s: i/o timeout", address)
+		return nil, fmt.Errorf("dial tcp: %s: i/o timeout", c.Server)
+	}
+}
+
+// Bind asks the server to wait for an inbound connection from the address.
+func (c *Client) Bind(ctx *daze.Context, network string, address string) (daze.Bound, error) {
+	srv, err := c.Open()
+	if err != nil {
+		return nil, err
+	}
+	spy := &ashe.Client{Cipher: c.Cipher, Limits: c.Limits}
+	bnd, err := spy.EstabBind(ctx, srv, network, address)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	return bnd, nil
+}
+
+// Dial connects to the address on the named network.
+func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+	srv, err := c.Open()
+	if err != nil {
+		return nil, err
+	}
+	spy := &ashe.Client{Cipher: c.Cipher}
+	con, err := spy.Estab(ctx, srv, network, address)
+	if err != nil {
+		srv.Close()
+		return nil, err
 	}
+	rtc := daze.NewLimitsConn(con, c.Limits)
+	return rtc, nil
 }
 
 // Run creates an establish connection to czar server.
@@ -5,10 +5,12 @@ import (
 	"encoding/binary"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libraries/daze/lib/doa"
 	"github.com/libraries/daze/lib/once"
+	"github.com/libraries/daze/lib/pool"
 	"github.com/libraries/daze/lib/priority"
 )
 
@@ -18,6 +20,7 @@ type Stream struct {
 	idx uint8
 	mux *Mux
 	rbf []byte
+	rbi int
 	rch chan []byte
 	rer *once.OnceErr
 	wer *once.OnceErr
@@ -42,6 +45,25 @@ func (s *Stream) Close() error {
 	return nil
 }
 
+// CloseWrite shuts down the writing side of the stream. The peer reads EOF, while reading from the stream continues.
+// Peers that have not announced the support of half close would drop the frame, the stream is fully closed instead.
+func (s *Stream) CloseWrite() error {
+	if !s.mux.hcw.Load() {
+		return s.Close()
+	}
+	return s.mux.pri.Pri(0, func() error {
+		if err := s.wer.Get(); err != nil {
+			return err
+		}
+		s.wer.Put(io.ErrClosedPipe)
+		mph := make([]byte, 4)
+		mph[0] = 0x04
+		mph[1] = s.idx
+		mph[2] = 0x00
+		return doa.Err(s.mux.con.Write(mph))
+	})
+}
+
 // Esolc closing a stream passively.
 func (s *Stream) Esolc() error {
 	s.rer.Put(io.EOF)
@@ -64,30 +86,46 @@ func (s *Stream) Esolc() error {
 
 // Read implements io.Reader.
 func (s *Stream) Read(p []byte) (int, error) {
-	if len(s.rbf) != 0 {
-		n := copy(p, s.rbf)
-		s.rbf = s.rbf[n:]
-		return n, nil
+	if s.rbf == nil {
+		if err := s.recv(); err != nil {
+			return 0, err
+		}
 	}
-	if len(s.rch) != 0 {
-		s.rbf = <-s.rch
-		n := copy(p, s.rbf)
-		s.rbf = s.rbf[n:]
-		return n, nil
+	n := copy(p, s.rbf[s.rbi:])
+	s.rbi += n
+	// The message is owned by the stream since it is received, and is put back once it is fully read.
+	if s.rbi == len(s.rbf) {
+		pool.Put(s.rbf)
+		s.rbf = nil
+		s.rbi = 0
+	}
+	return n, nil
+}
+
+// recv waits for the next message.
+func (s *Stream) recv() error {
+	select {
+	case s.rbf = <-s.rch:
+		return nil
+	default:
 	}
 	if err := s.rer.Get(); err != nil {
-		return 0, err
+		return err
 	}
 	select {
 	case s.rbf = <-s.rch:
-		n := copy(p, s.rbf)
-		s.rbf = s.rbf[n:]
-		return n, nil
+		return nil
 	case <-s.rer.Sig():
-		return 0, s.rer.Get()
+		// Messages received before the stream was half closed by the peer must be delivered first.
+		select {
+		case s.rbf = <-s.rch:
+			return nil
+		default:
+		}
+		return s.rer.Get()
 	case <-s.mux.rer.Sig():
 		s.rer.Put(s.mux.rer.Get())
-		return 0, s.mux.rer.Get()
+		return s.mux.rer.Get()
 	}
 }
 
@@ -103,14 +141,13 @@ func (s *Stream) Write(p []byte) (int, error) {
 	for {
 		switch {
 		case len(p) >= Conf.PacketSize-4:
-			buf = make([]byte, Conf.PacketSize)
 			l = Conf.PacketSize - 4
 		case len(p) >= 1:
-			buf = make([]byte, 4+len(p))
 			l = len(p)
 		case len(p) >= 0:
 			return n, nil
 		}
+		buf = pool.Get(4 + l)
 		buf[0] = 0x01
 		buf[1] = s.idx
 		binary.BigEndian.PutUint16(buf[2:4], uint16(l))
@@ -130,6 +167,7 @@ func (s *Stream) Write(p []byte) (int, error) {
 			}
 			return nil
 		})
+		pool.Put(buf)
 		if err != nil {
 			return n, err
 		}
@@ -143,7 +181,8 @@ func NewStream(idx uint8, mux *Mux) *Stream {
 		cat: time.Now(),
 		idx: idx,
 		mux: mux,
-		rbf: make([]byte, 0),
+		rbf: nil,
+		rbi: 0,
 		rch: make(chan []byte, 32),
 		rer: once.NewOnceErr(),
 		wer: once.NewOnceErr(),
@@ -165,6 +204,7 @@ func NewWither(idx uint8, mux *Mux) *Stream {
 type Mux struct {
 	ach chan *Stream
 	con io.ReadWriteCloser
+	hcw atomic.Bool
 	idp *Sip
 	pri *priority.Priority
 	rer *once.OnceErr
@@ -233,6 +273,13 @@ func (m *Mux) Recv() {
 		})
 		stm *Stream
 	)
+	// Announce the support of half close. Peers that know nothing about it ignore the frame.
+	go m.pri.Pri(0, func() error {
+		mph := make([]byte, 4)
+		mph[0] = 0x03
+		mph[1] = 0x02
+		return doa.Err(m.con.Write(mph))
+	})
 	for {
 		prb.Reset(Conf.IdleProbeDuration)
 		rst.Reset(Conf.IdleReplyDuration)
@@ -257,19 +304,23 @@ func (m *Mux) Recv() {
 			m.ach <- stm
 		case 0x01:
 			bsz = binary.BigEndian.Uint16(buf[2:4])
-			msg = make([]byte, bsz)
+			// The message is handed over to the stream, unless the stream has been closed.
+			msg = pool.Get(int(bsz))
 			_, err = io.ReadFull(m.con, msg)
 			if err != nil {
+				pool.Put(msg)
 				m.con.Close()
 				break
 			}
 			stm = m.usb[idx]
 			if stm.rer.Get() != nil {
+				pool.Put(msg)
 				break
 			}
 			select {
 			case stm.rch <- msg:
 			case <-stm.rer.Sig():
+				pool.Put(msg)
 			}
 		case 0x02:
 			stm = m.usb[idx]
@@ -286,7 +337,11 @@ func (m *Mux) Recv() {
 					return doa.Err(m.con.Write(mph))
 				})
 			case 0x01:
+			case 0x02:
+				m.hcw.Store(true)
 			}
+		case 0x04:
+			m.usb[idx].rer.Put(io.EOF)
 		}
 	}
 	close(m.ach)
@@ -1,13 +1,17 @@
 package czar
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
 	"log"
 	"math/rand/v2"
 	"net"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/libraries/daze"
 	"github.com/libraries/daze/lib/doa"
@@ -150,7 +154,10 @@ func TestProtocolCzarMuxServerReopen(t *testing.T) {
 	mph[1] = 0x00 // Sid
 	cli.Write(mph)
 	cli.Write(mph)
-	buf := make([]byte, 1)
+	buf := make([]byte, 4)
+	// The server announces the support of half close before anything else.
+	doa.Try(io.ReadFull(cli, buf[:4]))
+	doa.Doa(buf[0] == 0x03 && buf[1] == 0x02)
 	doa.Doa(doa.Err(io.ReadFull(cli, buf[:1])) != nil)
 }
 
@@ -183,3 +190,127 @@ func (t *Tester) Mux() error {
 	}()
 	return nil
 }
+
+func TestProtocolCzarMuxStreamCloseWrite(t *testing.T) {
+	c, s := net.Pipe()
+	cmx := NewMuxClient(c)
+	defer cmx.Close()
+	smx := NewMuxServer(s)
+	defer smx.Close()
+
+	cli := doa.Try(cmx.Open())
+	defer cli.Close()
+	srv := <-smx.Accept()
+	defer srv.Close()
+	for i := 0; !cmx.hcw.Load() || !smx.hcw.Load(); i++ {
+		doa.Doa(i < 200)
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	go func() {
+		doa.Try(cli.Write([]byte("ping")))
+		doa.Nil(cli.CloseWrite())
+	}()
+	doa.Doa(string(doa.Try(io.ReadAll(srv))) == "ping")
+	doa.Doa(doa.Err(cli.Write([]byte{0x00})) == io.ErrClosedPipe)
+	go func() {
+		doa.Try(srv.Write([]byte("pong")))
+		doa.Nil(srv.CloseWrite())
+	}()
+	doa.Doa(string(doa.Try(io.ReadAll(cli))) == "pong")
+}
+
+func TestProtocolCzarMuxStreamCloseWriteLegacy(t *testing.T) {
+	c, s := net.Pipe()
+	cmx := NewMuxClient(c)
+	defer cmx.Close()
+	defer s.Close()
+
+	// A legacy peer, which never announces the support of half close.
+	mph := make(chan []byte, 4)
+	go func() {
+		for {
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(s, buf); err != nil {
+				close(mph)
+				return
+			}
+			mph <- buf
+		}
+	}()
+	doa.Doa(bytes.Equal((<-mph)[:2], []byte{0x03, 0x02}))
+	cli := doa.Try(cmx.Open())
+	doa.Doa(bytes.Equal((<-mph)[:2], []byte{0x00, cli.idx}))
+	doa.Nil(cli.CloseWrite())
+	doa.Doa(bytes.Equal((<-mph)[:2], []byte{0x02, cli.idx}))
+	doa.Doa(doa.Err(cli.Read(make([]byte, 1))) == io.ErrClosedPipe)
+}
+
+// BenchmarkProtocolCzarMux relays packets over many concurrent streams of a mux.
+func BenchmarkProtocolCzarMux(b *testing.B) {
+	c, s := net.Pipe()
+	cmx := NewMuxClient(c)
+	defer cmx.Close()
+	smx := NewMuxServer(s)
+	defer smx.Close()
+	go func() {
+		for stm := range smx.Accept() {
+			go io.Copy(io.Discard, stm)
+		}
+	}()
+
+	buf := make([]byte, Conf.PacketSize-4)
+	stm := make([]*Stream, 64)
+	for i := range stm {
+		stm[i] = doa.Try(cmx.Open())
+	}
+	b.ReportAllocs()
+	m := runtime.MemStats{}
+	runtime.ReadMemStats(&m)
+	gc := m.NumGC
+	b.ResetTimer()
+	w := sync.WaitGroup{}
+	for _, e := range stm {
+		w.Go(func() {
+			for range b.N / len(stm) {
+				doa.Try(e.Write(buf))
+			}
+		})
+	}
+	w.Wait()
+	b.StopTimer()
+	runtime.ReadMemStats(&m)
+	b.ReportMetric(float64(m.NumGC-gc)/float64(b.N), "gc/op")
+	for _, e := range stm {
+		e.Close()
+	}
+}
+
+// BenchmarkProtocolCzarMuxParallel echoes packets over concurrent streams, each of them opened by its own goroutine.
+func BenchmarkProtocolCzarMuxParallel(b *testing.B) {
+	c, s := net.Pipe()
+	cmx := NewMuxClient(c)
+	defer cmx.Close()
+	smx := NewMuxServer(s)
+	defer smx.Close()
+	go func() {
+		for stm := range smx.Accept() {
+			go func() {
+				defer stm.Close()
+				io.Copy(stm, stm)
+			}()
+		}
+	}()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(Conf.PacketSize - 4))
+	b.RunParallel(func(pb *testing.PB) {
+		buf := make([]byte, Conf.PacketSize-4)
+		stm := doa.Try(cmx.Open())
+		defer stm.Close()
+		for pb.Next() {
+			doa.Try(stm.Write(buf))
+			doa.Try(io.ReadFull(stm, buf))
+		}
+	})
+}
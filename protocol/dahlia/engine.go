@@ -70,11 +70,7 @@ func (s *Server) Run() error {
 			idx++
 			ctx := &daze.Context{Cid: idx}
 			log.Printf("conn: %08x accept remote=%s", ctx.Cid, cli.RemoteAddr())
-			rtc := daze.ReadWriteCloser{
-				Reader: io.TeeReader(cli, rate.NewLimitsWriter(s.Limits)),
-				Writer: io.MultiWriter(cli, rate.NewLimitsWriter(s.Limits)),
-				Closer: cli,
-			}
+			rtc := daze.NewLimitsConn(cli, s.Limits)
 			go func() {
 				defer rtc.Close()
 				if err := s.Serve(ctx, rtc); err != nil {
@@ -149,11 +145,7 @@ func (c *Client) Run() error {
 				}
 				break
 			}
-			rtc := &daze.ReadWriteCloser{
-				Reader: io.TeeReader(cli, rate.NewLimitsWriter(c.Limits)),
-				Writer: io.MultiWriter(cli, rate.NewLimitsWriter(c.Limits)),
-				Closer: cli,
-			}
+			rtc := daze.NewLimitsConn(cli, c.Limits)
 			idx++
 			ctx := &daze.Context{Cid: idx}
 			log.Printf("conn: %08x accept remote=%s", ctx.Cid, cli.RemoteAddr())
@@ -70,6 +70,12 @@ func (s *Stream) Close() error {
 	return nil
 }
 
+// CloseWrite shuts down the writing side of the stream, any buffered data is sent to the peer before the fin.
+func (s *Stream) CloseWrite() error {
+	s.stm.CloseWrite()
+	return nil
+}
+
 // Read reads up to len(p) bytes.
 func (s *Stream) Read(p []byte) (int, error) {
 	return s.stm.Read(p)
@@ -145,11 +151,7 @@ func (s *Server) Run() error {
 					ctx := &daze.Context{Cid: cid}
 					cli := &Stream{rem: rem, stm: stm}
 					log.Printf("conn: %08x accept remote=%s", ctx.Cid, rem)
-					rtc := &daze.ReadWriteCloser{
-						Reader: io.TeeReader(cli, rate.NewLimitsWriter(s.Limits)),
-						Writer: io.MultiWriter(cli, rate.NewLimitsWriter(s.Limits)),
-						Closer: cli,
-					}
+					rtc := daze.NewLimitsConn(cli, s.Limits)
 					go func() {
 						defer rtc.Close()
 						if err := s.Serve(ctx, rtc); err != nil {
@@ -190,8 +192,8 @@ func (c *Client) Close() error {
 	return nil
 }
 
-// Dial connects to the address on the named network.
-func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+// Open creates a new quic connection with a single stream to the server.
+func (c *Client) Open() (*Stream, error) {
 	cty, end := context.WithTimeout(context.Background(), daze.Conf.DialerTimeout)
 	defer end()
 	con, err := c.EpQuic.Dial(cty, "udp", c.Server, ClientConfig.Do())
@@ -208,18 +210,37 @@ func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.Rea
 		return nil, err
 	}
 	rem := net.UDPAddrFromAddrPort(con.RemoteAddr())
-	srv := &Stream{con: con, rem: rem, stm: stm}
+	return &Stream{con: con, rem: rem, stm: stm}, nil
+}
+
+// Bind asks the server to wait for an inbound connection from the address.
+func (c *Client) Bind(ctx *daze.Context, network string, address string) (daze.Bound, error) {
+	srv, err := c.Open()
+	if err != nil {
+		return nil, err
+	}
+	spy := &ashe.Client{Cipher: c.Cipher, Limits: c.Limits}
+	bnd, err := spy.EstabBind(ctx, srv, network, address)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	return bnd, nil
+}
+
+// Dial connects to the address on the named network.
+func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+	srv, err := c.Open()
+	if err != nil {
+		return nil, err
+	}
 	spy := &ashe.Client{Cipher: c.Cipher}
 	out, err := spy.Estab(ctx, srv, network, address)
 	if err != nil {
 		srv.Close()
 		return nil, err
 	}
-	rtc := &daze.ReadWriteCloser{
-		Reader: io.TeeReader(out, rate.NewLimitsWriter(c.Limits)),
-		Writer: io.MultiWriter(out, rate.NewLimitsWriter(c.Limits)),
-		Closer: out,
-	}
+	rtc := daze.NewLimitsConn(out, c.Limits)
 	return rtc, nil
 }
 